@@ -0,0 +1,78 @@
+package config
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// AutoDetect treats any process that has a 3D graphics API loaded as a target with 'profile_on'.
+type AutoDetect struct {
+	Enabled    string   `json:"enabled"`
+	Exclude    []string `json:"exclude,omitempty"`     // process names that are never auto-detected, nil for the defaults
+	MinRuntime string   `json:"min_runtime,omitempty"` // duration a process must run before it counts, empty for the default
+
+	exclude    []Pattern
+	minRuntime time.Duration
+}
+
+// defaultAutoDetectExclude lists desktop apps that render with Direct3D, Vulkan or OpenGL but are not games.
+// The Linux names are the command names of /proc, which the kernel cuts to 15 characters.
+var defaultAutoDetectExclude = []string{
+	// Windows
+	"exact:dwm.exe",
+	"exact:explorer.exe",
+	"exact:msedge.exe",
+	"exact:chrome.exe",
+	"exact:firefox.exe",
+	"exact:discord.exe",
+	"exact:steamwebhelper.exe",
+	"exact:MSIAfterburner.exe",
+	// Linux
+	"exact:Xorg",
+	"exact:Xwayland",
+	"exact:gnome-shell",
+	"exact:kwin_x11",
+	"exact:kwin_wayland",
+	"exact:plasmashell",
+	"exact:chrome",
+	"exact:firefox",
+	"exact:Discord",
+	"exact:steamwebhelper",
+}
+
+// defaultAutoDetectMinRuntime keeps launchers and splash screens that exit quickly from being detected.
+const defaultAutoDetectMinRuntime = "30s"
+
+// IsEnabled reports whether auto-detection is switched on.
+func (a AutoDetect) IsEnabled() bool {
+	return strings.ToLower(a.Enabled) == "true"
+}
+
+// Excludes reports whether the process with the given exe name is never auto-detected.
+func (a AutoDetect) Excludes(name string) bool {
+	return matchAny(a.exclude, name)
+}
+
+// MinRuntimeDuration returns how long a process must have been running before it is auto-detected.
+func (a AutoDetect) MinRuntimeDuration() time.Duration {
+	return a.minRuntime
+}
+
+// compile validates the section and compiles its patterns.
+// An exclude list or minimum runtime that is not set gets the default, an empty list or "0s" turns it off.
+func (a *AutoDetect) compile() {
+	enabled := strings.ToLower(a.Enabled)
+	if enabled != "" && enabled != "true" && enabled != "false" {
+		log.Fatalf("Configuration error: 'auto_detect.enabled' must be either \"true\" or \"false\", but found %q. Please correct the value in %s.", a.Enabled, configFile)
+	}
+	exclude, minRuntime := a.Exclude, a.MinRuntime
+	if exclude == nil {
+		exclude = defaultAutoDetectExclude
+	}
+	if minRuntime == "" {
+		minRuntime = defaultAutoDetectMinRuntime
+	}
+	a.exclude = compilePatterns("auto_detect.exclude", exclude)
+	a.minRuntime = parseDuration("auto_detect.min_runtime", minRuntime)
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAutoDetectDefaults(t *testing.T) {
+	a := AutoDetect{Enabled: "true"}
+	a.compile()
+	for _, name := range []string{"dwm.exe", "MSIAfterburner.exe", "Xorg", "gnome-shell", "firefox"} {
+		if !a.Excludes(name) {
+			t.Errorf("Excludes(%q) = false, want the default exclude list to cover it", name)
+		}
+	}
+	if a.Excludes("game.exe") {
+		t.Error("Excludes(\"game.exe\") = true")
+	}
+	if got := a.MinRuntimeDuration(); got != 30*time.Second {
+		t.Errorf("MinRuntimeDuration() = %s, want the default 30s", got)
+	}
+}
+
+func TestAutoDetectExplicitEmpty(t *testing.T) {
+	a := AutoDetect{Enabled: "true", Exclude: []string{}, MinRuntime: "0s"}
+	a.compile()
+	if a.Excludes("explorer.exe") || a.Excludes("Xorg") {
+		t.Error("an empty exclude list still excludes the defaults")
+	}
+	if got := a.MinRuntimeDuration(); got != 0 {
+		t.Errorf("MinRuntimeDuration() = %s, want 0", got)
+	}
+}
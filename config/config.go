@@ -3,33 +3,79 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const configFile = "MSIAfterburnerProfileSwitcher.json"
 
 type Config struct {
-	AfterburnerPath string            `json:"afterburner_path"`
-	Notifications   string            `json:"notifications"`
-	ProfileOn       string            `json:"profile_on"`
-	ProfileOff      string            `json:"profile_off"`
-	DelaySeconds    int               `json:"delay_seconds"`
-	MonitoringMode  string            `json:"monitoring_mode"`
-	Overrides       map[string]string `json:"overrides"`
+	AfterburnerPath    string              `json:"afterburner_path"`
+	Notifications      string              `json:"notifications"`
+	ProfileOn          string              `json:"profile_on"`
+	ProfileOff         string              `json:"profile_off"`
+	DelaySeconds       int                 `json:"delay_seconds"`
+	MonitoringMode     string              `json:"monitoring_mode"`
+	ReconcileInterval  string              `json:"reconcile_interval,omitempty"`
+	PollMin            string              `json:"poll_min,omitempty"`
+	PollMax            string              `json:"poll_max,omitempty"`
+	ForegroundPolicy   string              `json:"foreground_policy"`
+	ConflictResolution string              `json:"conflict_resolution"`
+	ProfileRanks       map[string]int      `json:"profile_ranks,omitempty"`
+	Overrides          map[string]Override `json:"overrides"`
+
+	// RevertDelay is how long to wait after the last target disappeared before 'profile_off' is applied.
+	RevertDelay string `json:"revert_delay,omitempty"`
+	// MinDwell is how long a profile stays applied at least before the next switch.
+	MinDwell string `json:"min_dwell,omitempty"`
+
+	// Exclude lists processes and windows that never count as a target, even if a rule matches them.
+	// The windows of an excluded process are ignored too.
+	Exclude Filter `json:"exclude"`
+	// Transparent lists foreground apps, like overlays or chat, that do not count as leaving a target.
+	Transparent Filter `json:"transparent"`
+	// AutoDetect finds games by the graphics libraries they load, without listing them in 'overrides'.
+	AutoDetect AutoDetect `json:"auto_detect"`
+	// Cooldown applies a profile for a while after the last target exited, before 'profile_off'.
+	Cooldown Cooldown `json:"cooldown"`
+
+	// Rules holds the compiled overrides in the order they are tried, see compileOverrides.
+	Rules []Rule `json:"-"`
+
+	revertDelay time.Duration
+	minDwell    time.Duration
+	reconcile   time.Duration
+	pollMin     time.Duration
+	pollMax     time.Duration
 }
 
+// defaultReconcile is how often hybrid mode checks without an event, if 'reconcile_interval' is not set.
+const defaultReconcile = time.Minute
+
+// defaultPoll is the interval of poll mode if 'delay_seconds' is not set.
+const defaultPoll = 5 * time.Second
+
 func defaultConfig() Config {
 	return Config{
-		AfterburnerPath: `C:\Program Files (x86)\MSI Afterburner\MSIAfterburner.exe`,
-		Notifications:   "true",
-		ProfileOn:       "-Profile2",
-		ProfileOff:      "-Profile1",
-		DelaySeconds:    5,
-		MonitoringMode:  "event",
-		Overrides:       make(map[string]string),
+		AfterburnerPath:    `C:\Program Files (x86)\MSI Afterburner\MSIAfterburner.exe`,
+		Notifications:      "true",
+		ProfileOn:          "-Profile2",
+		ProfileOff:         "-Profile1",
+		DelaySeconds:       5,
+		MonitoringMode:     "event",
+		ForegroundPolicy:   PolicyAnyRunning,
+		ConflictResolution: ResolvePriority,
+		Overrides:          make(map[string]Override),
+		AutoDetect: AutoDetect{
+			Enabled:    "false",
+			Exclude:    defaultAutoDetectExclude,
+			MinRuntime: defaultAutoDetectMinRuntime,
+		},
+		Cooldown: Cooldown{Duration: defaultCooldownDuration},
 	}
 }
 
@@ -54,6 +100,57 @@ func validateProfileString(profile string) error {
 	return nil
 }
 
+// parseDuration parses a top-level duration option like "30s". An empty value is no delay.
+func parseDuration(option, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Fatalf("Configuration error: '%s' must be a duration like \"30s\" or \"2m\", but found %q. Please correct the value in %s.", option, value, configFile)
+	}
+	return d
+}
+
+// RevertDelayDuration returns how long to wait before falling back to 'profile_off'.
+func (c *Config) RevertDelayDuration() time.Duration {
+	return c.revertDelay
+}
+
+// MinDwellDuration returns how long a profile must stay applied before another switch.
+func (c *Config) MinDwellDuration() time.Duration {
+	return c.minDwell
+}
+
+// ReconcileDuration returns how often hybrid mode checks the state without waiting for an event.
+func (c *Config) ReconcileDuration() time.Duration {
+	if c.reconcile <= 0 {
+		return defaultReconcile
+	}
+	return c.reconcile
+}
+
+// PollIntervals returns the shortest and longest interval of poll mode. An unset 'poll_min' or
+// 'poll_max' is 'delay_seconds', so without them polling keeps the fixed pace of 'delay_seconds'.
+// An unset 'poll_min' is never longer than 'poll_max'.
+func (c *Config) PollIntervals() (fast, slow time.Duration) {
+	delay := time.Duration(c.DelaySeconds) * time.Second
+	if delay <= 0 {
+		delay = defaultPoll
+	}
+	fast, slow = c.pollMin, c.pollMax
+	if fast == 0 {
+		fast = delay
+		if slow != 0 {
+			fast = min(fast, slow)
+		}
+	}
+	if slow == 0 {
+		slow = max(fast, delay)
+	}
+	return fast, slow
+}
+
 func Load() Config {
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
 		log.Printf("Configuration file not found. Creating %s with default values.", configFile)
@@ -88,7 +185,11 @@ func Load() Config {
 		}
 	}(file)
 
-	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Fatalf("Fatal: Cannot read config file %s: %v", configFile, err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
 		log.Fatalf("Fatal: Could not parse config file %s. Please check for JSON syntax errors like a missing comma or quote. Details: %v", configFile, err)
 	}
 
@@ -103,16 +204,41 @@ func Load() Config {
 		log.Fatalf("Configuration error: 'notifications' must be either \"true\" or \"false\", but found %q. Please correct the value in %s.", cfg.Notifications, configFile)
 	}
 	mode := strings.ToLower(cfg.MonitoringMode)
-	if mode != "poll" && mode != "event" {
-		log.Fatalf("Configuration error: 'monitoring_mode' must be either \"poll\" or \"event\", but found %q. Please correct the value in %s.", cfg.MonitoringMode, configFile)
-	}
-	for target, profile := range cfg.Overrides {
-		delete(cfg.Overrides, target)
-		cfg.Overrides[strings.ToLower(target)] = profile
-		if err := validateProfileString(profile); err != nil {
-			log.Fatalf("Configuration error in 'overrides' for target %q. The profile must be like \"-ProfileN\" (where N is 1-5) or an empty string \"\" to use the default 'On' profile. Details: %v", target, err)
+	if mode != "poll" && mode != "event" && mode != "hybrid" {
+		log.Fatalf("Configuration error: 'monitoring_mode' must be \"poll\", \"event\" or \"hybrid\", but found %q. Please correct the value in %s.", cfg.MonitoringMode, configFile)
+	}
+	cfg.reconcile = parseDuration("reconcile_interval", cfg.ReconcileInterval)
+	cfg.pollMin = parseDuration("poll_min", cfg.PollMin)
+	cfg.pollMax = parseDuration("poll_max", cfg.PollMax)
+	if fast, slow := cfg.PollIntervals(); slow < fast {
+		log.Fatalf("Configuration error: 'poll_min' (%s) must not be longer than 'poll_max' (%s). Please correct the values in %s.", fast, slow, configFile)
+	}
+	cfg.ForegroundPolicy = strings.ToLower(cfg.ForegroundPolicy)
+	if cfg.ForegroundPolicy == "" {
+		cfg.ForegroundPolicy = PolicyAnyRunning
+	}
+	if err := validatePolicy(cfg.ForegroundPolicy); err != nil {
+		log.Fatalf("Configuration error: 'foreground_policy' must be \"foreground-only\", \"any-running\" or \"sticky\", but found %q. Please correct the value in %s.", cfg.ForegroundPolicy, configFile)
+	}
+	cfg.ConflictResolution = strings.ToLower(cfg.ConflictResolution)
+	if cfg.ConflictResolution == "" {
+		cfg.ConflictResolution = ResolvePriority
+	}
+	if err := validateConflictResolution(cfg.ConflictResolution); err != nil {
+		log.Fatalf("Configuration error: 'conflict_resolution' must be \"priority\", \"highest-rank\", \"lowest-rank\" or \"newest\", but found %q. Please correct the value in %s.", cfg.ConflictResolution, configFile)
+	}
+	for profile := range cfg.ProfileRanks {
+		if err := validateProfileString(profile); err != nil || profile == "" {
+			log.Fatalf("Configuration error in 'profile_ranks'. Every key must be a profile like \"-ProfileN\" where N is a number from 1 to 5. Details: %v", err)
 		}
 	}
+	cfg.revertDelay = parseDuration("revert_delay", cfg.RevertDelay)
+	cfg.minDwell = parseDuration("min_dwell", cfg.MinDwell)
+	compileOverrides(&cfg, overrideOrder(data))
+	cfg.Exclude.compile("exclude")
+	cfg.Transparent.compile("transparent")
+	cfg.AutoDetect.compile()
+	cfg.Cooldown.compile()
 
 	return cfg
 }
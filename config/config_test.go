@@ -0,0 +1,29 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollIntervals(t *testing.T) {
+	tests := []struct {
+		delay            int
+		pollMin, pollMax time.Duration
+		fast, slow       time.Duration
+	}{
+		{5, 0, 0, 5 * time.Second, 5 * time.Second},
+		{0, 0, 0, defaultPoll, defaultPoll},
+		{5, time.Second, 0, time.Second, 5 * time.Second},
+		{5, 0, 30 * time.Second, 5 * time.Second, 30 * time.Second},
+		{5, 10 * time.Second, 0, 10 * time.Second, 10 * time.Second},
+		// Only 'poll_max' below 'delay_seconds' polls at 'poll_max'.
+		{5, 0, 2 * time.Second, 2 * time.Second, 2 * time.Second},
+		{5, time.Second, 30 * time.Second, time.Second, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		c := Config{DelaySeconds: tt.delay, pollMin: tt.pollMin, pollMax: tt.pollMax}
+		if fast, slow := c.PollIntervals(); fast != tt.fast || slow != tt.slow {
+			t.Errorf("delay %ds, poll_min %s, poll_max %s: PollIntervals() = %s, %s, want %s, %s", tt.delay, tt.pollMin, tt.pollMax, fast, slow, tt.fast, tt.slow)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"log"
+	"time"
+)
+
+// Cooldown applies a profile for a while after the last target exited, before 'profile_off'.
+type Cooldown struct {
+	Profile    string `json:"profile"`               // empty disables the cooldown
+	Duration   string `json:"duration,omitempty"`    // how long the cooldown profile stays applied, empty for the default
+	MinSession string `json:"min_session,omitempty"` // only after a target was active this long
+
+	duration   time.Duration
+	minSession time.Duration
+}
+
+// defaultCooldownDuration is how long the cooldown profile stays applied without a 'duration'.
+const defaultCooldownDuration = "5m"
+
+// IsEnabled reports whether a cooldown profile is set.
+func (c Cooldown) IsEnabled() bool {
+	return c.Profile != "" && c.duration > 0
+}
+
+// Length returns how long the cooldown profile stays applied.
+func (c Cooldown) Length() time.Duration {
+	return c.duration
+}
+
+// MinSessionDuration returns how long a target must have been active before a cooldown follows.
+func (c Cooldown) MinSessionDuration() time.Duration {
+	return c.minSession
+}
+
+// compile validates the section and parses its durations. A cooldown profile without a duration
+// gets the default, "0s" turns the cooldown off.
+func (c *Cooldown) compile() {
+	if err := validateProfileString(c.Profile); err != nil {
+		log.Fatalf("Configuration error in 'cooldown.profile'. A valid profile must be like \"-ProfileN\" where N is a number from 1 to 5. Details: %v", err)
+	}
+	duration := c.Duration
+	if duration == "" {
+		duration = defaultCooldownDuration
+	}
+	c.duration = parseDuration("cooldown.duration", duration)
+	c.minSession = parseDuration("cooldown.min_session", c.MinSession)
+}
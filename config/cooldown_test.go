@@ -0,0 +1,26 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCooldownDefaults(t *testing.T) {
+	tests := []struct {
+		cooldown Cooldown
+		enabled  bool
+		length   time.Duration
+	}{
+		{Cooldown{}, false, 5 * time.Minute},
+		{Cooldown{Profile: "-Profile5"}, true, 5 * time.Minute},
+		{Cooldown{Profile: "-Profile5", Duration: "90s"}, true, 90 * time.Second},
+		{Cooldown{Profile: "-Profile5", Duration: "0s"}, false, 0},
+	}
+	for _, tt := range tests {
+		c := tt.cooldown
+		c.compile()
+		if c.IsEnabled() != tt.enabled || c.Length() != tt.length {
+			t.Errorf("%+v: IsEnabled() = %v, Length() = %s, want %v, %s", tt.cooldown, c.IsEnabled(), c.Length(), tt.enabled, tt.length)
+		}
+	}
+}
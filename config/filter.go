@@ -0,0 +1,53 @@
+package config
+
+import (
+	"log"
+)
+
+// Filter is a list of processes and windows, used by the 'exclude' and 'transparent' sections.
+// The entries use the same syntax as the keys of 'overrides'.
+type Filter struct {
+	Processes []string `json:"processes,omitempty"` // process names
+	Titles    []string `json:"titles,omitempty"`    // window titles
+
+	processes []Pattern
+	titles    []Pattern
+}
+
+// MatchesProcess reports whether the process with the given exe name is in the filter.
+func (f Filter) MatchesProcess(name string) bool {
+	return name != "" && matchAny(f.processes, name)
+}
+
+// MatchesTitle reports whether the window with the given title is in the filter.
+func (f Filter) MatchesTitle(title string) bool {
+	return title != "" && matchAny(f.titles, title)
+}
+
+// compile compiles the entries of the filter, section is its name in the config file.
+func (f *Filter) compile(section string) {
+	f.processes = compilePatterns(section+".processes", f.Processes)
+	f.titles = compilePatterns(section+".titles", f.Titles)
+}
+
+func matchAny(patterns []Pattern, text string) bool {
+	for _, p := range patterns {
+		if p.Match(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// compilePatterns compiles the entries of a pattern list like 'exclude.processes'.
+func compilePatterns(section string, entries []string) []Pattern {
+	patterns := make([]Pattern, 0, len(entries))
+	for _, entry := range entries {
+		p, err := parsePattern(entry)
+		if err != nil {
+			log.Fatalf("Configuration error in '%s' for entry %q. Use a plain keyword, \"exact:name\", \"glob:pattern\" or \"regex:expression\". Details: %v", section, entry, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Match modes of an override key. The mode is selected with a prefix on the key,
+// a key without a prefix keeps the case-insensitive substring matching.
+const (
+	MatchContains = "contains"
+	MatchExact    = "exact"
+	MatchGlob     = "glob"
+	MatchRegex    = "regex"
+	MatchDir      = "dir"
+	MatchAppID    = "appid"
+)
+
+// Pattern is a compiled override key. All modes ignore case.
+type Pattern struct {
+	Key  string // the key as written in the config
+	Mode string
+	Text string // the key without its mode prefix
+	re   *regexp.Regexp
+}
+
+// parsePattern compiles an override key like "acc.exe", "exact:acc.exe",
+// "glob:*-win64-shipping.exe", "regex:rdr[0-9]\.exe" or "dir:D:\SteamLibrary\steamapps\common".
+// Glob and regex patterns are anchored and must match the whole text.
+// A dir pattern matches every path below the directory, an appid pattern like "appid:1091500"
+// matches the Steam AppID of the game.
+func parsePattern(key string) (Pattern, error) {
+	p := Pattern{Key: key, Mode: MatchContains, Text: strings.ToLower(key)}
+	mode, text, found := strings.Cut(key, ":")
+	if !found {
+		return p, nil
+	}
+	switch strings.ToLower(mode) {
+	case MatchExact:
+		p.Mode, p.Text = MatchExact, strings.ToLower(text)
+	case MatchGlob:
+		p.Mode, p.Text = MatchGlob, text
+		p.re = regexp.MustCompile(globToRegexp(text))
+	case MatchRegex:
+		p.Mode, p.Text = MatchRegex, text
+		re, err := regexp.Compile(`(?i)^(?:` + text + `)$`)
+		if err != nil {
+			return p, fmt.Errorf("invalid regular expression %q: %v", text, err)
+		}
+		p.re = re
+	case MatchDir:
+		p.Mode, p.Text = MatchDir, dirPrefix(text)
+		if strings.Trim(text, `\/`) == "" {
+			p.Text = ""
+		}
+	case MatchAppID:
+		p.Mode, p.Text = MatchAppID, strings.TrimSpace(text)
+		if strings.Trim(p.Text, "0123456789") != "" {
+			return p, fmt.Errorf("invalid Steam AppID %q (must be a number)", text)
+		}
+	default:
+		// Not a mode prefix, e.g. a window title like "Mission: Impossible".
+		return p, nil
+	}
+	if p.Text == "" {
+		return p, fmt.Errorf("empty %s pattern", p.Mode)
+	}
+	return p, nil
+}
+
+// globToRegexp translates a glob where '*' matches any run of characters and '?' a single one.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString(`(?i)^`)
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString(`$`)
+	return b.String()
+}
+
+// Match reports whether text matches the pattern.
+func (p Pattern) Match(text string) bool {
+	switch p.Mode {
+	case MatchExact:
+		return strings.EqualFold(text, p.Text)
+	case MatchAppID:
+		return text == p.Text
+	case MatchGlob, MatchRegex:
+		return p.re.MatchString(text)
+	case MatchDir:
+		return strings.HasPrefix(normalizePath(text), p.Text)
+	default:
+		return strings.Contains(strings.ToLower(text), p.Text)
+	}
+}
+
+// Specificity ranks how narrow a pattern is. Exact names beat glob and regex patterns,
+// which beat substrings, and within a mode a longer pattern beats a shorter one.
+func (p Pattern) Specificity() int {
+	rank := 1
+	switch p.Mode {
+	case MatchExact, MatchAppID:
+		rank = 3
+	case MatchGlob, MatchRegex, MatchDir:
+		rank = 2
+	}
+	return rank<<16 + len(p.Text)
+}
+
+// normalizePath lowercases a path and converts it to forward slashes, so Windows and
+// Linux paths compare the same way.
+func normalizePath(p string) string {
+	return strings.ToLower(strings.ReplaceAll(p, `\`, "/"))
+}
+
+// dirPrefix normalizes a directory and ends it with a slash, so "games" does not match "games2".
+func dirPrefix(dir string) string {
+	return strings.TrimRight(normalizePath(dir), "/") + "/"
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tests := []struct {
+		key  string
+		text string
+		want bool
+	}{
+		{"acc.exe", "acc.exe", true},
+		{"acc.exe", "xacc.exe", true}, // a plain key keeps substring matching
+		{"exact:acc.exe", "acc.exe", true},
+		{"exact:acc.exe", "ACC.EXE", true},
+		{"exact:acc.exe", "xacc.exe", false},
+		{"glob:*-win64-shipping.exe", "DeadIsland-Win64-Shipping.exe", true},
+		{"glob:*-win64-shipping.exe", "deadisland-win64-shipping.exe.bak", false},
+		{"glob:game?.exe", "game2.exe", true},
+		{"glob:game?.exe", "mygame2.exe", false},
+		{"glob:game.exe", "gameXexe", false}, // the dot is literal
+		{`regex:rdr[0-9]\.exe`, "RDR2.exe", true},
+		{`regex:rdr[0-9]\.exe`, "xrdr2.exe", false},
+		{`regex:rdr[0-9]\.exe`, "rdr2.exe.old", false},
+		{"regex:a|b", "ab", false}, // the anchors apply to every alternative
+		{`dir:D:\Games`, `d:\games\Witcher 3\witcher3.exe`, true},
+		{`dir:D:\Games\`, "D:/Games/game.exe", true},
+		{`dir:D:\Games`, `D:\Games2\game.exe`, false},
+		{"appid:1091500", "1091500", true},
+		{"appid:1091500", "10915000", false},
+		{"Mission: Impossible", "mission: impossible - rogue nation", true},
+	}
+	for _, tt := range tests {
+		p, err := parsePattern(tt.key)
+		if err != nil {
+			t.Errorf("parsePattern(%q): %v", tt.key, err)
+			continue
+		}
+		if got := p.Match(tt.text); got != tt.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", tt.key, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParsePatternErrors(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string // part of the error message
+	}{
+		{"regex:rdr[0-9", "invalid regular expression"},
+		{"regex:(a", "invalid regular expression"},
+		{"exact:", "empty exact pattern"},
+		{"glob:", "empty glob pattern"},
+		{`dir:\`, "empty dir pattern"},
+		{"appid:cyberpunk", "invalid Steam AppID"},
+	}
+	for _, tt := range tests {
+		_, err := parsePattern(tt.key)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parsePattern(%q) error = %v, want one about %q", tt.key, err, tt.want)
+		}
+	}
+}
+
+func TestSpecificity(t *testing.T) {
+	order := []string{"exact:game.exe", "glob:game*.exe", "game"}
+	for i := 1; i < len(order); i++ {
+		a, _ := parsePattern(order[i-1])
+		b, _ := parsePattern(order[i])
+		if a.Specificity() <= b.Specificity() {
+			t.Errorf("%q is not more specific than %q", order[i-1], order[i])
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scopes of a rule, they select what the key is matched against.
+const (
+	ScopeAny   = "any"   // the exe name or a window title
+	ScopeExe   = "exe"   // the exe name, e.g. "rdr2.exe"
+	ScopePath  = "path"  // the full exe path
+	ScopeTitle = "title" // a window title
+	ScopeAppID = "appid" // the Steam AppID from the environment, only for "appid:" keys
+)
+
+// Foreground policies, they decide whether a target has to be in the foreground.
+const (
+	PolicyForegroundOnly = "foreground-only" // only while the target has the focus
+	PolicyAnyRunning     = "any-running"     // while the target runs, focused or not
+	PolicySticky         = "sticky"          // from the first focus until the target exits
+)
+
+// Override is the value of an entry in 'overrides'. In the config file it is either
+// a profile string or an object that also sets the options of the rule.
+type Override struct {
+	Profile  string `json:"profile"`
+	Scope    string `json:"scope,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Policy   string `json:"policy,omitempty"`
+	Args     string `json:"args,omitempty"` // pattern for the command line of the process
+
+	Parent     string `json:"parent,omitempty"`      // pattern for the name of the parent process
+	Ancestor   string `json:"ancestor,omitempty"`    // pattern for the name of any ancestor process
+	MinRuntime string `json:"min_runtime,omitempty"` // duration the process must have been running, e.g. "30s"
+
+	MinCPU      float64 `json:"min_cpu,omitempty"`       // CPU percent of the process, 100 is one full core
+	MinMemoryMB uint64  `json:"min_memory_mb,omitempty"` // resident memory of the process
+	Sample      string  `json:"sample,omitempty"`        // shortest window the CPU percent is averaged over, "1s" by default
+
+	ApplyAfter string `json:"apply_after,omitempty"` // duration the target must be detected before its profile is applied
+
+	Steps []Step `json:"steps,omitempty"` // timed profiles that follow Profile while the target stays active
+}
+
+// Step is one stage of a timed profile sequence. Its profile replaces the one before
+// once the target has been active for After. An empty profile is 'profile_on'.
+type Step struct {
+	Profile string `json:"profile"`
+	After   string `json:"after,omitempty"`
+}
+
+// compiledStep is a Step with its delay parsed.
+type compiledStep struct {
+	profile string
+	after   time.Duration
+}
+
+// defaultSample is the window the CPU percent of a rule is measured over without a 'sample' option.
+const defaultSample = time.Second
+
+// Rule is an entry of 'overrides' compiled by Load.
+type Rule struct {
+	Pattern
+	Override
+	Order int // position of the entry in the config file
+
+	args       *Pattern
+	parent     *Pattern
+	ancestor   *Pattern
+	minRuntime time.Duration
+	sample     time.Duration
+	applyAfter time.Duration
+	steps      []compiledStep // sorted by their delay
+}
+
+// HasArgs reports whether the rule has a condition on the command line.
+func (r Rule) HasArgs() bool {
+	return r.args != nil
+}
+
+// MatchArgs reports whether the command line, with the arguments joined by spaces, meets the args condition.
+func (r Rule) MatchArgs(cmdline string) bool {
+	return r.args == nil || r.args.Match(cmdline)
+}
+
+// HasParent reports whether the rule has a condition on the parent process.
+func (r Rule) HasParent() bool {
+	return r.parent != nil
+}
+
+// MatchParent reports whether the name of the parent process meets the parent condition.
+func (r Rule) MatchParent(name string) bool {
+	return r.parent == nil || r.parent.Match(name)
+}
+
+// HasAncestor reports whether the rule has a condition on the ancestor processes.
+func (r Rule) HasAncestor() bool {
+	return r.ancestor != nil
+}
+
+// MatchAncestor reports whether the name of an ancestor process meets the ancestor condition.
+func (r Rule) MatchAncestor(name string) bool {
+	return r.ancestor == nil || r.ancestor.Match(name)
+}
+
+// MinRuntimeDuration returns how long the process must have been running, 0 without condition.
+func (r Rule) MinRuntimeDuration() time.Duration {
+	return r.minRuntime
+}
+
+// ApplyAfterDuration returns how long the target must be detected without a break before its profile is applied.
+func (r Rule) ApplyAfterDuration() time.Duration {
+	return r.applyAfter
+}
+
+// Rule returns the compiled rule with the given key.
+func (c *Config) Rule(key string) (Rule, bool) {
+	for _, rule := range c.Rules {
+		if rule.Key == key {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// HasUsage reports whether the rule has a condition on the CPU or memory usage of the process.
+func (r Rule) HasUsage() bool {
+	return r.MinCPU > 0 || r.MinMemoryMB > 0
+}
+
+// SampleWindow returns the window the CPU percent is measured over, 0 if the rule has no CPU condition.
+func (r Rule) SampleWindow() time.Duration {
+	if r.MinCPU <= 0 {
+		return 0
+	}
+	return r.sample
+}
+
+// MatchUsage reports whether the measured CPU percent and resident memory in bytes meet the usage conditions.
+func (r Rule) MatchUsage(cpu float64, rss uint64) bool {
+	return cpu >= r.MinCPU && rss >= r.MinMemoryMB*1024*1024
+}
+
+// UnmarshalJSON reads an override from a profile string, a list of timed steps or an object.
+func (o *Override) UnmarshalJSON(data []byte) error {
+	var profile string
+	if err := json.Unmarshal(data, &profile); err == nil {
+		*o = Override{Profile: profile}
+		return nil
+	}
+	var steps []Step
+	if err := json.Unmarshal(data, &steps); err == nil {
+		*o = Override{Steps: steps}
+		return nil
+	}
+	type plain Override
+	if err := json.Unmarshal(data, (*plain)(o)); err != nil {
+		return fmt.Errorf("an override must be a profile string, a list of steps or an object: %v", err)
+	}
+	return nil
+}
+
+// MarshalJSON writes an Override without options as a plain profile string,
+// or as a plain list if it only has steps.
+func (o Override) MarshalJSON() ([]byte, error) {
+	options := o
+	options.Steps = nil
+	if reflect.DeepEqual(options, Override{Profile: o.Profile}) {
+		if len(o.Steps) == 0 {
+			return json.Marshal(o.Profile)
+		}
+		if o.Profile == "" {
+			return json.Marshal(o.Steps)
+		}
+	}
+	type plain Override
+	return json.Marshal(plain(o))
+}
+
+func validateScope(scope string) error {
+	switch scope {
+	case "", ScopeAny, ScopeExe, ScopePath, ScopeTitle:
+		return nil
+	}
+	return fmt.Errorf("invalid scope %q (must be %q, %q, %q or %q)", scope, ScopeAny, ScopeExe, ScopePath, ScopeTitle)
+}
+
+func validatePolicy(policy string) error {
+	switch policy {
+	case PolicyForegroundOnly, PolicyAnyRunning, PolicySticky:
+		return nil
+	}
+	return fmt.Errorf("invalid policy %q (must be %q, %q or %q)", policy, PolicyForegroundOnly, PolicyAnyRunning, PolicySticky)
+}
+
+// Covers reports whether the rule is matched against the given scope.
+func (r Rule) Covers(scope string) bool {
+	switch r.Scope {
+	case ScopeAny:
+		return scope == ScopeExe || scope == ScopeTitle
+	default:
+		return r.Scope == scope
+	}
+}
+
+// normalize lowercases the options and fills in their defaults.
+// A rule without a policy uses the global 'foreground_policy'.
+func (o Override) normalize(defaultPolicy string) Override {
+	o.Scope = strings.ToLower(o.Scope)
+	if o.Scope == "" {
+		o.Scope = ScopeAny
+	}
+	o.Policy = strings.ToLower(o.Policy)
+	if o.Policy == "" {
+		o.Policy = defaultPolicy
+	}
+	return o
+}
+
+// compileOverrides validates cfg.Overrides and builds cfg.Rules from it.
+// The rules are sorted by priority, then by specificity and then by their order in the file,
+// so the first rule that matches is always the same one.
+func compileOverrides(cfg *Config, order map[string]int) {
+	overrides := make(map[string]Override, len(cfg.Overrides))
+	cfg.Rules = nil
+	for target, override := range cfg.Overrides {
+		if err := validateProfileString(override.Profile); err != nil {
+			log.Fatalf("Configuration error in 'overrides' for target %q. The profile must be like \"-ProfileN\" (where N is 1-5) or an empty string \"\" to use the default 'On' profile. Details: %v", target, err)
+		}
+		override = override.normalize(cfg.ForegroundPolicy)
+		if err := validateScope(override.Scope); err != nil {
+			log.Fatalf("Configuration error in 'overrides' for target %q. Details: %v", target, err)
+		}
+		if err := validatePolicy(override.Policy); err != nil {
+			log.Fatalf("Configuration error in 'overrides' for target %q. Details: %v", target, err)
+		}
+		pattern, err := parsePattern(target)
+		if err != nil {
+			log.Fatalf("Configuration error in 'overrides' for target %q. Use a plain keyword, \"exact:name\", \"glob:pattern\" or \"regex:expression\". Details: %v", target, err)
+		}
+		if pattern.Mode == MatchDir {
+			if override.Scope != ScopeAny && override.Scope != ScopePath {
+				log.Fatalf("Configuration error in 'overrides' for target %q. A \"dir:\" key only matches exe paths, its scope must be %q. Details: scope is %q", target, ScopePath, override.Scope)
+			}
+			override.Scope = ScopePath
+		}
+		if pattern.Mode == MatchAppID {
+			if override.Scope != ScopeAny {
+				log.Fatalf("Configuration error in 'overrides' for target %q. An \"appid:\" key only matches Steam AppIDs, leave out its scope. Details: scope is %q", target, override.Scope)
+			}
+			override.Scope = ScopeAppID
+		}
+		// Glob and regex patterns keep their case, \D and \d mean different things.
+		if pattern.re == nil {
+			pattern.Key = strings.ToLower(target)
+		}
+		rule := Rule{Pattern: pattern, Override: override, Order: order[target]}
+		rule.args = compileOption(target, "args", override.Args)
+		rule.parent = compileOption(target, "parent", override.Parent)
+		rule.ancestor = compileOption(target, "ancestor", override.Ancestor)
+		rule.minRuntime = parseDurationOption(target, "min_runtime", override.MinRuntime)
+		rule.applyAfter = parseDurationOption(target, "apply_after", override.ApplyAfter)
+		rule.steps = compileSteps(target, override.Steps)
+		rule.sample = parseDurationOption(target, "sample", override.Sample)
+		if rule.sample == 0 {
+			rule.sample = defaultSample
+		}
+		if override.MinCPU < 0 {
+			log.Fatalf("Configuration error in 'overrides' for target %q. The 'min_cpu' option must not be negative, but found %v.", target, override.MinCPU)
+		}
+		overrides[pattern.Key] = override
+		cfg.Rules = append(cfg.Rules, rule)
+	}
+	cfg.Overrides = overrides
+	sort.SliceStable(cfg.Rules, func(i, j int) bool {
+		a, b := cfg.Rules[i], cfg.Rules[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if a.Specificity() != b.Specificity() {
+			return a.Specificity() > b.Specificity()
+		}
+		if a.Order != b.Order {
+			return a.Order < b.Order
+		}
+		return a.Key < b.Key
+	})
+}
+
+// compileOption compiles a pattern option of the rule for target, nil if the option is not set.
+func compileOption(target, option, value string) *Pattern {
+	if value == "" {
+		return nil
+	}
+	p, err := parsePattern(value)
+	if err != nil {
+		log.Fatalf("Configuration error in 'overrides' for target %q. The '%s' option uses the same syntax as the keys. Details: %v", target, option, err)
+	}
+	return &p
+}
+
+// compileSteps validates the timed steps of the rule for target and sorts them by their delay.
+func compileSteps(target string, steps []Step) []compiledStep {
+	var compiled []compiledStep
+	for _, step := range steps {
+		if err := validateProfileString(step.Profile); err != nil {
+			log.Fatalf("Configuration error in 'overrides' for target %q. Every step needs a profile like \"-ProfileN\" (where N is 1-5) or an empty string \"\" to use the default 'On' profile. Details: %v", target, err)
+		}
+		compiled = append(compiled, compiledStep{profile: step.Profile, after: parseDurationOption(target, "after", step.After)})
+	}
+	sort.SliceStable(compiled, func(i, j int) bool {
+		return compiled[i].after < compiled[j].after
+	})
+	return compiled
+}
+
+// parseDurationOption parses a duration option of the rule for target, 0 if the option is not set.
+func parseDurationOption(target, option, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Fatalf("Configuration error in 'overrides' for target %q. The '%s' option must be a duration like \"30s\" or \"2m\", but found %q.", target, option, value)
+	}
+	return d
+}
+
+// overrideOrder returns the position of every key of the 'overrides' object in data.
+// encoding/json decodes objects into maps, which forget the order of the file.
+func overrideOrder(data []byte) map[string]int {
+	order := make(map[string]int)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return order
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return order
+		}
+		if key, _ := t.(string); key != "overrides" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return order
+			}
+			continue
+		}
+		if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+			return order
+		}
+		for dec.More() {
+			t, err := dec.Token()
+			if err != nil {
+				return order
+			}
+			key, _ := t.(string)
+			order[key] = len(order)
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return order
+			}
+		}
+		return order
+	}
+	return order
+}
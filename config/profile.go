@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conflict resolutions, they decide which target wins when several are active.
+const (
+	ResolvePriority    = "priority"     // the foreground target, then the rule order
+	ResolveHighestRank = "highest-rank" // the target whose profile has the highest rank
+	ResolveLowestRank  = "lowest-rank"  // the target whose profile has the lowest rank
+	ResolveNewest      = "newest"       // the most recently started target
+)
+
+func validateConflictResolution(resolution string) error {
+	switch resolution {
+	case ResolvePriority, ResolveHighestRank, ResolveLowestRank, ResolveNewest:
+		return nil
+	}
+	return fmt.Errorf("invalid conflict resolution %q (must be %q, %q, %q or %q)", resolution, ResolvePriority, ResolveHighestRank, ResolveLowestRank, ResolveNewest)
+}
+
+// TargetProfile returns the profile of the rule with the given key, or 'profile_on' if the rule has none.
+func (c *Config) TargetProfile(key string) string {
+	if profile := c.Overrides[key].Profile; profile != "" {
+		return profile
+	}
+	return c.ProfileOn
+}
+
+// TargetProfileAt returns the profile of the target with the given key once it has been active for elapsed,
+// following the timed steps of its rule. next is the time left until the following step, 0 after the last one.
+func (c *Config) TargetProfileAt(key string, elapsed time.Duration) (profile string, next time.Duration) {
+	profile = c.TargetProfile(key)
+	rule, ok := c.Rule(key)
+	if !ok {
+		return profile, 0
+	}
+	for _, step := range rule.steps {
+		if step.after > elapsed {
+			return profile, step.after - elapsed
+		}
+		profile = step.profile
+		if profile == "" {
+			profile = c.ProfileOn
+		}
+	}
+	return profile, 0
+}
+
+// ProfileRank returns the rank of a profile from 'profile_ranks'.
+// A profile without an entry ranks by its number, so "-Profile5" outranks "-Profile4".
+func (c *Config) ProfileRank(profile string) int {
+	if rank, ok := c.ProfileRanks[profile]; ok {
+		return rank
+	}
+	num, _ := strconv.Atoi(strings.TrimPrefix(profile, "-Profile"))
+	return num
+}
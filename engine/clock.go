@@ -0,0 +1,25 @@
+package engine
+
+import "time"
+
+// Clock is the time source of an Engine, so the timing of its decisions can be tested.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call scheduled by a Clock.
+type Timer interface {
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by the time package.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,287 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"MSIAfterburnerProfileSwitcher/config"
+	"MSIAfterburnerProfileSwitcher/watcher"
+)
+
+// checkStateAndApplyProfile is the core logic for determining and applying a profile.
+// It keeps the decision while a transparent app has the focus, and otherwise picks the target from
+// the rules and auto-detection that has warmed up for its 'apply_after'. The target's profile follows
+// its timed steps; without a target the cooldown profile or 'profile_off' applies, after 'revert_delay'
+// and 'min_dwell' allow the switch. The caller holds e.mutex.
+func (e *Engine) checkStateAndApplyProfile() {
+	cfg := &e.cfg
+
+	// A transparent app like an overlay or chat in the foreground keeps the previous decision.
+	if e.currentProfile != "" && e.detector.TransparentForeground(cfg) {
+		return
+	}
+
+	// The list of targets is the compiled keys of the Overrides map.
+	// The watcher will prioritize the foreground application, unless a conflict resolution says otherwise.
+	activeTarget, isActive := e.selectTarget()
+	if wait := e.detector.RecheckAfter(); wait > 0 {
+		e.recheck(&e.conditions, wait)
+	} else {
+		stop(&e.conditions)
+	}
+
+	var desiredProfile string
+	var nextStep time.Duration
+	next := PhaseIdle
+
+	if isActive {
+		desiredProfile, nextStep = e.targetProfile(activeTarget)
+		next = PhaseActive
+		e.lostAt = time.Time{}
+	} else if e.coolingDown() {
+		// After a session the cooldown profile runs for a while before 'profile_off'.
+		desiredProfile = cfg.Cooldown.Profile
+		next = PhaseCooldown
+	} else {
+		desiredProfile = cfg.ProfileOff
+	}
+	if activeTarget == "" {
+		activeTarget = "None"
+	}
+
+	if desiredProfile == e.currentProfile && next == e.phase {
+		// A target that came back during 'revert_delay' cancels the pending revert.
+		stop(&e.pending)
+		if isActive {
+			e.follow(activeTarget, nextStep)
+		}
+		return
+	}
+
+	// Quick alt-tabs or a window that is re-created must not switch back and forth.
+	if !e.settled(isActive) {
+		return
+	}
+	if desiredProfile != e.currentProfile {
+		title := fmt.Sprintf("Detected: %s", activeTarget)
+		if next == PhaseCooldown {
+			log.Printf("Application exited: '%s', cooling down with profile %s for %s", e.target, strings.TrimLeft(desiredProfile, "-Profile"), cfg.Cooldown.Length())
+			title = fmt.Sprintf("Cooldown after %s (%s)", e.target, cfg.Cooldown.Length())
+		} else {
+			log.Printf("Running application detected: '%s', Desired profile: %s", activeTarget, strings.TrimLeft(desiredProfile, "-Profile"))
+		}
+		if err := e.applier.Apply(cfg, title, desiredProfile); err != nil {
+			log.Printf("Failed to apply profile %s: %v", strings.TrimLeft(desiredProfile, "-Profile"), err)
+		}
+		e.currentProfile = desiredProfile
+		e.appliedAt = e.Clock.Now()
+		e.lostAt = time.Time{}
+	}
+	if isActive {
+		e.follow(activeTarget, nextStep)
+	}
+	e.enter(next)
+}
+
+// selectTarget picks the active target whose profile is applied, following 'conflict_resolution'.
+// A target with 'apply_after' does not count until it has been detected long enough.
+func (e *Engine) selectTarget() (string, bool) {
+	cfg := &e.cfg
+	withWarmup := slices.ContainsFunc(cfg.Rules, func(rule config.Rule) bool { return rule.ApplyAfterDuration() > 0 })
+	if !withWarmup {
+		e.resetWarmup()
+		if cfg.ConflictResolution == config.ResolvePriority {
+			return e.detector.FirstActiveTarget(cfg)
+		}
+	}
+	matches := e.detector.ActiveTargets(cfg)
+	if withWarmup {
+		matches = e.warmedUp(matches)
+	}
+	if len(matches) == 0 {
+		return "", false
+	}
+	best := matches[0]
+	for _, m := range matches[1:] {
+		switch cfg.ConflictResolution {
+		case config.ResolveHighestRank:
+			if cfg.ProfileRank(cfg.TargetProfile(m.Key)) > cfg.ProfileRank(cfg.TargetProfile(best.Key)) {
+				best = m
+			}
+		case config.ResolveLowestRank:
+			if cfg.ProfileRank(cfg.TargetProfile(m.Key)) < cfg.ProfileRank(cfg.TargetProfile(best.Key)) {
+				best = m
+			}
+		case config.ResolveNewest:
+			if m.CreateTime > best.CreateTime {
+				best = m
+			}
+		}
+	}
+	return best.Key, true
+}
+
+// warmedUp records when each match was first detected and returns the matches whose 'apply_after'
+// has passed, in their order. While a match is still warming up, a timer runs the check again at the
+// moment the first one will have passed, so event mode does not have to wait for the next WinEvent.
+// Targets that were not detected in this check start over.
+func (e *Engine) warmedUp(matches []watcher.Match) []watcher.Match {
+	now := e.Clock.Now()
+	detected := make(map[string]bool, len(matches))
+	var ready []watcher.Match
+	var wait time.Duration
+	for _, m := range matches {
+		detected[m.Key] = true
+		rule, _ := e.cfg.Rule(m.Key)
+		delay := rule.ApplyAfterDuration()
+		if delay <= 0 {
+			ready = append(ready, m)
+			continue
+		}
+		first, ok := e.firstSeen[m.Key]
+		if !ok {
+			first = now
+			e.firstSeen[m.Key] = now
+			log.Printf("Running application detected: '%s', waiting %s before applying its profile", m.Key, delay)
+		}
+		if left := first.Add(delay).Sub(now); left > 0 {
+			if wait == 0 || left < wait {
+				wait = left
+			}
+			continue
+		}
+		ready = append(ready, m)
+	}
+	for key := range e.firstSeen {
+		if !detected[key] {
+			delete(e.firstSeen, key)
+		}
+	}
+	if wait > 0 {
+		e.recheck(&e.warmup, wait)
+	} else {
+		stop(&e.warmup)
+	}
+	return ready
+}
+
+// resetWarmup forgets all pending targets, because no rule has 'apply_after'.
+func (e *Engine) resetWarmup() {
+	clear(e.firstSeen)
+	stop(&e.warmup)
+}
+
+// targetProfile returns the profile of the active target, following the timed steps of its rule,
+// and the time until its next step, 0 if none. The steps of a target other than the one whose
+// profile is applied start from the beginning. It changes nothing, as the switch may be held back.
+func (e *Engine) targetProfile(target string) (string, time.Duration) {
+	var elapsed time.Duration
+	if target == e.stepTarget {
+		elapsed = e.Clock.Now().Sub(e.stepStart)
+	}
+	return e.cfg.TargetProfileAt(target, elapsed)
+}
+
+// follow makes target the active one once its profile is applied, and runs the check at its next step.
+// A different target starts its steps over and cancels the pending step of the previous one.
+func (e *Engine) follow(target string, nextStep time.Duration) {
+	e.target = target
+	if target != e.stepTarget {
+		e.stepTarget, e.stepStart = target, e.Clock.Now()
+	}
+	if nextStep > 0 {
+		e.recheck(&e.step, nextStep)
+	} else {
+		stop(&e.step)
+	}
+}
+
+// resetSteps cancels the pending step, because the target's profile was reverted or another one took over.
+func (e *Engine) resetSteps() {
+	e.stepTarget = ""
+	stop(&e.step)
+}
+
+// settled reports whether the profile may switch away from currentProfile now.
+// Falling back to 'profile_off' waits for 'revert_delay' after the last target disappeared,
+// and any switch waits until the current profile has been applied for 'min_dwell'.
+// While a switch is held back, a timer runs the check again when it is due.
+func (e *Engine) settled(isActive bool) bool {
+	if e.currentProfile == "" {
+		return true
+	}
+	now := e.Clock.Now()
+	var wait time.Duration
+	if !isActive && e.phase == PhaseActive {
+		delay := e.cfg.RevertDelayDuration()
+		if e.lostAt.IsZero() {
+			e.lostAt = now
+			if delay > 0 {
+				log.Printf("No running application detected, reverting to profile %s in %s", strings.TrimLeft(e.cfg.ProfileOff, "-Profile"), delay)
+			}
+		}
+		wait = e.lostAt.Add(delay).Sub(now)
+	}
+	if dwell := e.appliedAt.Add(e.cfg.MinDwellDuration()).Sub(now); dwell > wait {
+		wait = dwell
+	}
+	if wait > 0 {
+		e.recheck(&e.pending, wait)
+		return false
+	}
+	stop(&e.pending)
+	return true
+}
+
+// coolingDown reports whether the cooldown profile applies now that no target is active.
+// A cooldown follows a session that lasted at least 'cooldown.min_session' and ends after 'cooldown.duration'.
+func (e *Engine) coolingDown() bool {
+	switch e.phase {
+	case PhaseCooldown:
+		return e.Clock.Now().Before(e.cooldownEnd)
+	case PhaseActive:
+		return e.cfg.Cooldown.IsEnabled() && e.Clock.Now().Sub(e.sessionStart) >= e.cfg.Cooldown.MinSessionDuration()
+	}
+	return false
+}
+
+// enter moves the engine to the next phase after its profile was applied.
+// A target that comes back cancels a running cooldown. Leaving the active phase ends the timed steps,
+// while a revert that is held back by 'revert_delay' keeps them, so a quick alt-tab does not restart them.
+func (e *Engine) enter(next Phase) {
+	now := e.Clock.Now()
+	if next != PhaseActive {
+		e.resetSteps()
+	}
+	switch {
+	case next == PhaseActive && e.phase == PhaseCooldown:
+		log.Printf("Cooldown cancelled, running application detected: '%s'", e.target)
+		stop(&e.cooldown)
+		e.sessionStart = now
+	case next == PhaseActive && e.phase == PhaseIdle:
+		e.sessionStart = now
+	case next == PhaseCooldown && e.phase != PhaseCooldown:
+		e.cooldownEnd = now.Add(e.cfg.Cooldown.Length())
+		e.recheck(&e.cooldown, e.cfg.Cooldown.Length())
+	case next == PhaseIdle:
+		stop(&e.cooldown)
+	}
+	e.phase = next
+}
+
+// recheck replaces the timer in slot with one that runs the check after d.
+func (e *Engine) recheck(slot *Timer, d time.Duration) {
+	stop(slot)
+	*slot = e.Clock.AfterFunc(d, e.check)
+}
+
+// stop cancels the timer in slot, if any.
+func stop(slot *Timer) {
+	if *slot != nil {
+		(*slot).Stop()
+		*slot = nil
+	}
+}
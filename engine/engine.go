@@ -0,0 +1,364 @@
+// Package engine decides which Afterburner profile applies and switches to it.
+// It runs the polling or event loop of 'monitoring_mode' on its own, so it can be embedded without the tray.
+package engine
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"MSIAfterburnerProfileSwitcher/config"
+	"MSIAfterburnerProfileSwitcher/watcher"
+)
+
+// Applier applies an Afterburner profile like "-Profile2". The title heads the notification of the switch.
+type Applier interface {
+	Apply(cfg *config.Config, title, profile string) error
+}
+
+// ApplierFunc adapts a function to an Applier.
+type ApplierFunc func(cfg *config.Config, title, profile string) error
+
+func (f ApplierFunc) Apply(cfg *config.Config, title, profile string) error {
+	return f(cfg, title, profile)
+}
+
+// Phase is where the engine stands between a target being active and idle.
+type Phase string
+
+const (
+	PhaseIdle     Phase = "idle"     // 'profile_off' is applied
+	PhaseActive   Phase = "active"   // the profile of a target is applied
+	PhaseCooldown Phase = "cooldown" // the cooldown profile is applied after the last target exited
+)
+
+// Hooks are the system event hooks installed by Engine.Events.
+type Hooks interface {
+	// Done is closed when the hooks no longer deliver events, after Stop or because they failed.
+	Done() <-chan struct{}
+	// Err waits for Done and returns why the hooks failed, nil if they were stopped.
+	Err() error
+	// Healthy reports whether the hooks still seem to deliver events.
+	Healthy() bool
+	// Stop removes the hooks.
+	Stop()
+}
+
+// maxHookRestarts is how often in a row the watchdog of hybrid mode reinstalls the event hooks before it
+// falls back to polling. A healthy reconcile tick starts the count over.
+const maxHookRestarts = 3
+
+// State is a snapshot of the decisions of an Engine.
+type State struct {
+	Profile   string // the applied profile, empty before the first check
+	Phase     Phase
+	Target    string    // the target whose profile is applied, empty unless Phase is PhaseActive
+	AppliedAt time.Time // when Profile was applied
+}
+
+// Engine detects the active target and applies its profile.
+// The monitoring loop, events and its own timers all check through it, so it is guarded by a mutex.
+type Engine struct {
+	// Clock is the time source. New sets SystemClock, tests may replace it before the first check.
+	Clock Clock
+	// Reload returns the config for the next check of the monitoring loop.
+	// Without it the engine keeps the config it was created with.
+	Reload func(current config.Config) config.Config
+	// Events installs the system event hooks of event and hybrid mode and calls handler with every batch
+	// of events. Without it both modes fall back to polling.
+	Events func(handler func([]watcher.Event)) (Hooks, error)
+
+	detector *watcher.Detector
+	applier  Applier
+
+	mutex   sync.Mutex
+	cfg     config.Config
+	cancel  context.CancelFunc
+	done    chan struct{}
+	stopped bool
+
+	currentProfile string
+	phase          Phase
+	target         string // the active target, for the log
+
+	// sessionStart is when a target became active after idle or cooldown, for 'cooldown.min_session'.
+	sessionStart time.Time
+	// cooldown runs the check again when the cooldown is over.
+	cooldown    Timer
+	cooldownEnd time.Time
+
+	// firstSeen is when each target was first detected in an unbroken run of checks, for 'apply_after'.
+	firstSeen map[string]time.Time
+	// warmup re-runs the check when the 'apply_after' of a pending target has passed.
+	warmup Timer
+
+	// stepTarget is the target whose timed steps run since stepStart, step runs the check at the next step.
+	stepTarget string
+	stepStart  time.Time
+	step       Timer
+
+	// conditions re-runs the check when a condition of the detector that did not hold yet, like
+	// 'min_runtime' or 'min_cpu', may hold, because no event announces that.
+	conditions Timer
+
+	// appliedAt is when currentProfile was applied, for 'min_dwell'.
+	appliedAt time.Time
+	// lostAt is when the last target disappeared, for 'revert_delay'. It is zero while a target is active.
+	lostAt time.Time
+	// pending re-runs the check when a switch held back by 'revert_delay' or 'min_dwell' is due,
+	// so it happens even if no further event arrives.
+	pending Timer
+}
+
+// New returns an Engine that finds targets with detector and switches profiles with applier.
+// A nil detector uses the native sources of the platform.
+func New(cfg config.Config, detector *watcher.Detector, applier Applier) *Engine {
+	if detector == nil {
+		detector = watcher.NewDetector()
+	}
+	return &Engine{
+		Clock:     SystemClock{},
+		detector:  detector,
+		applier:   applier,
+		cfg:       cfg,
+		phase:     PhaseIdle,
+		firstSeen: make(map[string]time.Time),
+	}
+}
+
+// Start runs the monitoring loop of 'monitoring_mode' in the background, beginning with a check.
+// It runs until ctx is done or Stop is called.
+func (e *Engine) Start(ctx context.Context) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.cancel != nil {
+		return errors.New("engine already started")
+	}
+	ctx, e.cancel = context.WithCancel(ctx)
+	e.done = make(chan struct{})
+	e.stopped = false
+	go e.run(ctx, e.cfg)
+	return nil
+}
+
+// Stop ends the monitoring loop and cancels the pending timers. The applied profile stays as it is.
+func (e *Engine) Stop() {
+	e.mutex.Lock()
+	cancel, done := e.cancel, e.done
+	e.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// State returns a snapshot of the current decision.
+func (e *Engine) State() State {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	st := State{Profile: e.currentProfile, Phase: e.phase, AppliedAt: e.appliedAt}
+	if e.phase == PhaseActive {
+		st.Target = e.target
+	}
+	return st
+}
+
+// Check detects the active target and applies its profile right away, outside of the monitoring loop.
+func (e *Engine) Check() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.checkStateAndApplyProfile()
+}
+
+// check is the check of the timers, it does nothing once the engine is stopped.
+func (e *Engine) check() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.stopped {
+		return
+	}
+	e.checkStateAndApplyProfile()
+}
+
+// reloadAndCheck reloads the config and checks the state, for the monitoring loop.
+func (e *Engine) reloadAndCheck() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.stopped {
+		return
+	}
+	if e.Reload != nil {
+		e.cfg = e.Reload(e.cfg)
+	}
+	e.checkStateAndApplyProfile()
+}
+
+// handleEvents reloads the config and checks the state, unless no event of the batch can change the decision.
+func (e *Engine) handleEvents(batch []watcher.Event) {
+	e.mutex.Lock()
+	relevant := slices.ContainsFunc(batch, e.relevant)
+	e.mutex.Unlock()
+	if relevant {
+		e.reloadAndCheck()
+	}
+}
+
+// relevant reports whether an event can change which target is active. The caller holds e.mutex.
+// Windows that open and close only matter to rules on window titles, and to conditions that become
+// true while the target runs, which the steady stream of window events used to pick up.
+func (e *Engine) relevant(ev watcher.Event) bool {
+	switch ev.Kind {
+	case watcher.WindowCreated, watcher.WindowDestroyed:
+		if e.cfg.AutoDetect.IsEnabled() {
+			return true
+		}
+		for _, rule := range e.cfg.Rules {
+			if rule.Covers(config.ScopeTitle) || rule.MinRuntimeDuration() > 0 || rule.HasUsage() {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// run is the monitoring loop. The monitoring mode and delay only change on restart.
+func (e *Engine) run(ctx context.Context, cfg config.Config) {
+	defer e.finish()
+	switch mode := strings.ToLower(cfg.MonitoringMode); mode {
+	case "event", "hybrid":
+		if e.Events == nil {
+			log.Println("Event-Driven Mode is not available, falling back to Polling Mode")
+			break
+		}
+		if mode == "hybrid" {
+			log.Printf("Starting in Hybrid Mode, reconciling every %s", cfg.ReconcileDuration())
+		} else {
+			log.Println("Starting in Event-Driven Mode")
+		}
+		e.check()
+		if e.watchEvents(ctx, cfg, mode == "hybrid") {
+			return
+		}
+		log.Println("Falling back to Polling Mode")
+	}
+	fast, slow := cfg.PollIntervals()
+	if fast == slow {
+		log.Println("Starting in Polling Mode")
+	} else {
+		log.Printf("Starting in Polling Mode, every %s to %s", fast, slow)
+	}
+	e.check()
+	interval := fast
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			last := e.State().AppliedAt
+			e.reloadAndCheck()
+			interval = e.nextPoll(interval, fast, slow, last)
+			timer.Reset(interval)
+		}
+	}
+}
+
+// pollBackoff is the factor the poll interval grows by after each idle check.
+const pollBackoff = 2
+
+// nextPoll returns the interval until the next poll. It polls fast while a target is running, warming
+// up or cooling down, and right after a switch, so an exit is noticed quickly. While idle the
+// interval doubles up to slow. lastApplied is when the profile was applied before the last check.
+func (e *Engine) nextPoll(interval, fast, slow time.Duration, lastApplied time.Time) time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.phase != PhaseIdle || e.warmup != nil || !e.appliedAt.Equal(lastApplied) {
+		return fast
+	}
+	return min(interval*pollBackoff, slow)
+}
+
+// watchEvents checks on every relevant batch of events until ctx is done, then it returns true.
+// In hybrid mode it also checks on a slow reconcile tick, and a watchdog reinstalls the hooks when
+// their message loop ends or they stop delivering. It returns false to fall back to polling.
+func (e *Engine) watchEvents(ctx context.Context, cfg config.Config, hybrid bool) bool {
+	handler := func(batch []watcher.Event) {
+		if ctx.Err() == nil {
+			e.handleEvents(batch)
+		}
+	}
+	hooks, err := e.Events(handler)
+	if err != nil {
+		log.Printf("Could not install the event hooks: %v", err)
+		return false
+	}
+	var reconcile <-chan time.Time
+	if hybrid {
+		ticker := time.NewTicker(cfg.ReconcileDuration())
+		defer ticker.Stop()
+		reconcile = ticker.C
+	}
+	restarts, unhealthy := 0, 0
+	for {
+		select {
+		case <-ctx.Done():
+			hooks.Stop()
+			return true
+		case <-reconcile:
+			e.reloadAndCheck()
+			// A focus change right before the tick can look like a lost event, so wait for a second one.
+			if hooks.Healthy() {
+				restarts, unhealthy = 0, 0
+				continue
+			}
+			if unhealthy++; unhealthy < 2 {
+				continue
+			}
+			log.Println("The event hooks stopped delivering events")
+			hooks.Stop()
+		case <-hooks.Done():
+			if err := hooks.Err(); err != nil {
+				log.Printf("The event hooks stopped: %v", err)
+			} else {
+				log.Println("The event hooks stopped")
+			}
+			if !hybrid {
+				return false
+			}
+		}
+		if restarts == maxHookRestarts {
+			log.Printf("The event hooks failed %d times, giving up on them", restarts+1)
+			return false
+		}
+		restarts++
+		unhealthy = 0
+		log.Printf("Reinstalling the event hooks (attempt %d of %d)", restarts, maxHookRestarts)
+		if hooks, err = e.Events(handler); err != nil {
+			log.Printf("Could not install the event hooks: %v", err)
+			return false
+		}
+		e.reloadAndCheck()
+	}
+}
+
+// finish marks the engine as stopped when the monitoring loop returns.
+func (e *Engine) finish() {
+	e.mutex.Lock()
+	e.stopped = true
+	e.cancel()
+	e.cancel = nil
+	for _, slot := range []*Timer{&e.cooldown, &e.warmup, &e.conditions, &e.step, &e.pending} {
+		stop(slot)
+	}
+	done := e.done
+	e.mutex.Unlock()
+	close(done)
+}
@@ -0,0 +1,571 @@
+package engine
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"MSIAfterburnerProfileSwitcher/config"
+	"MSIAfterburnerProfileSwitcher/internal/configtest"
+	"MSIAfterburnerProfileSwitcher/watcher"
+)
+
+// fakeClock is a Clock that only moves on Advance, firing the timers that become due on the way.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	pending bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_000_000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f, pending: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	was := t.pending
+	t.pending = false
+	return was
+}
+
+// Advance moves the clock forward by d. Each timer that becomes due fires at its own time, in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, t := range c.timers {
+			if t.pending && !t.at.After(end) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.pending = false
+		c.now = next.at
+		c.mutex.Unlock()
+		next.f()
+		c.mutex.Lock()
+	}
+	c.now = end
+	c.timers = slices.DeleteFunc(c.timers, func(t *fakeTimer) bool { return !t.pending })
+	c.mutex.Unlock()
+}
+
+// recorder is an Applier that remembers the applied profiles.
+type recorder struct {
+	profiles []string
+}
+
+func (r *recorder) Apply(cfg *config.Config, title, profile string) error {
+	r.profiles = append(r.profiles, profile)
+	return nil
+}
+
+func (r *recorder) last() string {
+	if len(r.profiles) == 0 {
+		return ""
+	}
+	return r.profiles[len(r.profiles)-1]
+}
+
+// newTestEngine returns an Engine on a fake clock that detects the processes of src,
+// with the config of the shared test options and the given ones.
+func newTestEngine(t *testing.T, options string, src *watcher.FakeSource) (*Engine, *fakeClock, *recorder) {
+	t.Helper()
+	clock, applied := newFakeClock(), &recorder{}
+	detector := src.Detector()
+	detector.Now = clock.Now
+	e := New(configtest.Load(t, options), detector, applied)
+	e.Clock = clock
+	return e, clock, applied
+}
+
+// running returns a snapshot in which the processes with the given names are running.
+func running(names ...string) watcher.Snapshot {
+	var s watcher.Snapshot
+	for i, name := range names {
+		s.Processes = append(s.Processes, watcher.Process{PID: int32(i + 1), Name: name})
+	}
+	return s
+}
+
+// expect checks the applied profile and the target of the engine.
+func expect(t *testing.T, e *Engine, applied *recorder, profile, target string) {
+	t.Helper()
+	st := e.State()
+	if applied.last() != profile || st.Target != target {
+		t.Fatalf("applied %q with target %q, want %q with target %q (all applied: %v)", applied.last(), st.Target, profile, target, applied.profiles)
+	}
+}
+
+const warmupConfig = `"overrides": {
+	"exact:a.exe": "-Profile3",
+	"exact:b.exe": {"profile": "-Profile4", "priority": 10, "apply_after": "10s"}
+}`
+
+func TestApplyAfterWaitsOnTheClock(t *testing.T) {
+	src := watcher.NewFakeSource(running("b.exe"))
+	e, clock, applied := newTestEngine(t, warmupConfig, src)
+	e.Check()
+	expect(t, e, applied, "-Profile1", "")
+	clock.Advance(9 * time.Second)
+	expect(t, e, applied, "-Profile1", "")
+	// The warm-up timer runs the check without any event or poll.
+	clock.Advance(time.Second)
+	expect(t, e, applied, "-Profile4", "exact:b.exe")
+}
+
+func TestWarmingTargetKeepsTheRunningOne(t *testing.T) {
+	src := watcher.NewFakeSource(running("a.exe"))
+	e, clock, applied := newTestEngine(t, warmupConfig, src)
+	e.Check()
+	expect(t, e, applied, "-Profile3", "exact:a.exe")
+	// b.exe has the higher priority, but until it has warmed up a.exe stays active.
+	src.Set(running("a.exe", "b.exe"))
+	e.Check()
+	expect(t, e, applied, "-Profile3", "exact:a.exe")
+	clock.Advance(5 * time.Second)
+	e.Check()
+	expect(t, e, applied, "-Profile3", "exact:a.exe")
+	clock.Advance(5 * time.Second)
+	expect(t, e, applied, "-Profile4", "exact:b.exe")
+	if !slices.Equal(applied.profiles, []string{"-Profile3", "-Profile4"}) {
+		t.Errorf("applied %v, want a.exe and then b.exe without profile_off in between", applied.profiles)
+	}
+}
+
+func TestWarmupContinuesWhileAnotherTargetWins(t *testing.T) {
+	src := watcher.NewFakeSource(running("a.exe", "b.exe"))
+	e, clock, applied := newTestEngine(t, `"overrides": {
+		"exact:a.exe": {"profile": "-Profile3", "priority": 10},
+		"exact:b.exe": {"profile": "-Profile4", "apply_after": "10s"}
+	}`, src)
+	for i := 0; i < 12; i++ {
+		e.Check()
+		expect(t, e, applied, "-Profile3", "exact:a.exe")
+		clock.Advance(time.Second)
+	}
+	// b.exe ran all along, so it takes over right away when a.exe exits.
+	src.Set(running("b.exe"))
+	e.Check()
+	expect(t, e, applied, "-Profile4", "exact:b.exe")
+}
+
+func TestRestartedTargetWarmsUpAgain(t *testing.T) {
+	src := watcher.NewFakeSource(running("b.exe"))
+	e, clock, applied := newTestEngine(t, warmupConfig, src)
+	e.Check()
+	clock.Advance(8 * time.Second)
+	src.Set(running())
+	e.Check()
+	src.Set(running("b.exe"))
+	e.Check()
+	clock.Advance(8 * time.Second)
+	expect(t, e, applied, "-Profile1", "")
+	clock.Advance(2 * time.Second)
+	expect(t, e, applied, "-Profile4", "exact:b.exe")
+}
+
+func TestAltTabKeepsTheSteps(t *testing.T) {
+	game := watcher.Snapshot{
+		Processes:  []watcher.Process{{PID: 1, Name: "game.exe"}, {PID: 2, Name: "explorer.exe"}},
+		Foreground: &watcher.Foreground{PID: 1, Exe: `C:\Games\game.exe`},
+	}
+	desktop := game
+	desktop.Foreground = &watcher.Foreground{PID: 2, Exe: `C:\Windows\explorer.exe`}
+	src := watcher.NewFakeSource(game)
+	e, clock, applied := newTestEngine(t, `"foreground_policy": "foreground-only", "revert_delay": "10s",
+		"overrides": {"exact:game.exe": [{"profile": "-Profile3"}, {"profile": "-Profile4", "after": "1m"}]}`, src)
+	e.Check()
+	expect(t, e, applied, "-Profile3", "exact:game.exe")
+	// Alt-tab away and back every 20 seconds, within 'revert_delay'.
+	for i := 0; i < 2; i++ {
+		clock.Advance(20 * time.Second)
+		src.Set(desktop)
+		e.Check()
+		clock.Advance(5 * time.Second)
+		src.Set(game)
+		e.Check()
+		expect(t, e, applied, "-Profile3", "exact:game.exe")
+	}
+	clock.Advance(10 * time.Second)
+	expect(t, e, applied, "-Profile4", "exact:game.exe")
+	// Leaving for longer than 'revert_delay' reverts the profile and starts the steps over.
+	src.Set(desktop)
+	e.Check()
+	clock.Advance(10 * time.Second)
+	expect(t, e, applied, "-Profile1", "")
+	src.Set(game)
+	e.Check()
+	expect(t, e, applied, "-Profile3", "exact:game.exe")
+}
+
+func TestConflictResolution(t *testing.T) {
+	src := watcher.NewFakeSource(watcher.Snapshot{Processes: []watcher.Process{
+		{PID: 1, Name: "a.exe", CreateTime: 2000},
+		{PID: 2, Name: "b.exe", CreateTime: 1000},
+		{PID: 3, Name: "c.exe", CreateTime: 3000},
+	}})
+	tests := []struct {
+		resolution string
+		ranks      string
+		want       string
+	}{
+		{"priority", `{}`, "exact:a.exe"},
+		{"highest-rank", `{}`, "exact:b.exe"},
+		{"highest-rank", `{"-Profile3": 9}`, "exact:a.exe"},
+		{"lowest-rank", `{}`, "exact:a.exe"},
+		{"lowest-rank", `{"-Profile3": 9}`, "exact:c.exe"},
+		{"newest", `{}`, "exact:c.exe"},
+	}
+	for _, tt := range tests {
+		e, _, applied := newTestEngine(t, `"conflict_resolution": "`+tt.resolution+`", "profile_ranks": `+tt.ranks+`,
+			"overrides": {"exact:a.exe": "-Profile3", "exact:b.exe": "-Profile5", "exact:c.exe": "-Profile4"}`, src)
+		e.Check()
+		if got := e.State().Target; got != tt.want {
+			t.Errorf("%s with ranks %s: target %q, want %q (applied %v)", tt.resolution, tt.ranks, got, tt.want, applied.profiles)
+		}
+	}
+}
+
+func TestExitAfterTheWindowClosedSwitchesBack(t *testing.T) {
+	src := watcher.NewFakeSource(running("a.exe"))
+	e, _, applied := newTestEngine(t, warmupConfig, src)
+	e.Check()
+	expect(t, e, applied, "-Profile3", "exact:a.exe")
+	// The window is gone, but a.exe is still shutting down: rules on exe names skip the check.
+	n := len(applied.profiles)
+	e.handleEvents([]watcher.Event{{Kind: watcher.WindowDestroyed, Window: 1, PID: 1}})
+	if len(applied.profiles) != n {
+		t.Fatalf("applied %v after the destroy, want no check", applied.profiles)
+	}
+	// The tracker reports the exit once a.exe is gone.
+	src.Set(watcher.Snapshot{})
+	e.handleEvents([]watcher.Event{{Kind: watcher.ProcessExited, PID: 1}})
+	expect(t, e, applied, "-Profile1", "")
+}
+
+func TestAutoDetectAppliesWhenMinRuntimeIsUp(t *testing.T) {
+	// The game starts when the test does.
+	start := newFakeClock().Now()
+	src := watcher.NewFakeSource(watcher.Snapshot{
+		Processes: []watcher.Process{{PID: 7, Name: "game.exe", CreateTime: start.UnixMilli()}},
+		Modules:   map[int32][]string{7: {`C:\Windows\System32\d3d12.dll`}},
+	})
+	e, clock, applied := newTestEngine(t, `"auto_detect": {"enabled": "true"}`, src)
+	e.Check()
+	expect(t, e, applied, "-Profile1", "")
+	// No event arrives, the default 'min_runtime' of 30s runs out on its own.
+	clock.Advance(29 * time.Second)
+	expect(t, e, applied, "-Profile1", "")
+	clock.Advance(time.Second)
+	expect(t, e, applied, "-Profile2", "auto:game.exe")
+}
+
+func TestMinCPUIsSampledWithoutEvents(t *testing.T) {
+	bench := func(cpu time.Duration) watcher.Snapshot {
+		return watcher.Snapshot{
+			Processes: []watcher.Process{{PID: 3, Name: "bench.exe", CreateTime: 1}},
+			Usages:    map[int32]watcher.Usage{3: {CPUTime: cpu}},
+		}
+	}
+	src := watcher.NewFakeSource(bench(0))
+	e, clock, applied := newTestEngine(t, `"overrides": {"exact:bench.exe": {"profile": "-Profile5", "min_cpu": 50}}`, src)
+	e.Check()
+	// The benchmark idles in its menu for a few seconds.
+	clock.Advance(3 * time.Second)
+	expect(t, e, applied, "-Profile1", "")
+	// Then it gets busy inside the same window, no event announces that.
+	src.Set(bench(900 * time.Millisecond))
+	clock.Advance(time.Second)
+	expect(t, e, applied, "-Profile5", "exact:bench.exe")
+}
+
+const cooldownConfig = `"cooldown": {"profile": "-Profile5", "min_session": "10m"},
+	"overrides": {"exact:game.exe": "-Profile3"}`
+
+// expectPhase checks the applied profile and the phase of the engine.
+func expectPhase(t *testing.T, e *Engine, applied *recorder, profile string, phase Phase) {
+	t.Helper()
+	if st := e.State(); applied.last() != profile || st.Phase != phase {
+		t.Fatalf("applied %q in phase %s, want %q in phase %s (all applied: %v)", applied.last(), st.Phase, profile, phase, applied.profiles)
+	}
+}
+
+func TestCooldownRunsAndEnds(t *testing.T) {
+	src := watcher.NewFakeSource(running("game.exe"))
+	e, clock, applied := newTestEngine(t, cooldownConfig, src)
+	e.Check()
+	expectPhase(t, e, applied, "-Profile3", PhaseActive)
+	clock.Advance(10 * time.Minute)
+	src.Set(running())
+	e.Check()
+	expectPhase(t, e, applied, "-Profile5", PhaseCooldown)
+	// The default 'duration' of 5m ends the cooldown without another check.
+	clock.Advance(5*time.Minute - time.Second)
+	expectPhase(t, e, applied, "-Profile5", PhaseCooldown)
+	clock.Advance(time.Second)
+	expectPhase(t, e, applied, "-Profile1", PhaseIdle)
+}
+
+func TestCooldownCancelledByReturningTarget(t *testing.T) {
+	src := watcher.NewFakeSource(running("game.exe"))
+	e, clock, applied := newTestEngine(t, cooldownConfig, src)
+	e.Check()
+	clock.Advance(time.Hour)
+	src.Set(running())
+	e.Check()
+	expectPhase(t, e, applied, "-Profile5", PhaseCooldown)
+	clock.Advance(time.Minute)
+	src.Set(running("game.exe"))
+	e.Check()
+	expectPhase(t, e, applied, "-Profile3", PhaseActive)
+	// The timer of the cancelled cooldown does not switch to 'profile_off' later.
+	clock.Advance(5 * time.Minute)
+	expectPhase(t, e, applied, "-Profile3", PhaseActive)
+	// The session started over when the game came back, 5 minutes are too short for another cooldown.
+	src.Set(running())
+	e.Check()
+	expectPhase(t, e, applied, "-Profile1", PhaseIdle)
+}
+
+func TestShortSessionSkipsCooldown(t *testing.T) {
+	src := watcher.NewFakeSource(running("game.exe"))
+	e, clock, applied := newTestEngine(t, cooldownConfig, src)
+	e.Check()
+	clock.Advance(9 * time.Minute)
+	src.Set(running())
+	e.Check()
+	expectPhase(t, e, applied, "-Profile1", PhaseIdle)
+	if slices.Contains(applied.profiles, "-Profile5") {
+		t.Errorf("applied %v, want no cooldown after a session shorter than 'min_session'", applied.profiles)
+	}
+}
+
+const dwellStepsConfig = `"min_dwell": "30s",
+	"overrides": {
+		"exact:a.exe": [{"profile": "-Profile3"}, {"profile": "-Profile4", "after": "1m"}],
+		"exact:b.exe": {"profile": "-Profile5", "priority": 10}
+	}`
+
+func TestHeldSwitchKeepsTheSteps(t *testing.T) {
+	src := watcher.NewFakeSource(running("a.exe"))
+	e, clock, applied := newTestEngine(t, dwellStepsConfig, src)
+	e.Check()
+	clock.Advance(time.Minute)
+	expect(t, e, applied, "-Profile4", "exact:a.exe")
+	// b.exe shows up while 'min_dwell' holds the profile of the step, and goes away before it is over.
+	clock.Advance(10 * time.Second)
+	src.Set(running("a.exe", "b.exe"))
+	e.Check()
+	expect(t, e, applied, "-Profile4", "exact:a.exe")
+	clock.Advance(10 * time.Second)
+	src.Set(running("a.exe"))
+	e.Check()
+	clock.Advance(time.Minute)
+	expect(t, e, applied, "-Profile4", "exact:a.exe")
+	if !slices.Equal(applied.profiles, []string{"-Profile3", "-Profile4"}) {
+		t.Errorf("applied %v, want a.exe to stay on its second step", applied.profiles)
+	}
+}
+
+func TestSwitchAfterDwellRestartsTheSteps(t *testing.T) {
+	src := watcher.NewFakeSource(running("a.exe"))
+	e, clock, applied := newTestEngine(t, dwellStepsConfig, src)
+	e.Check()
+	clock.Advance(time.Minute)
+	src.Set(running("a.exe", "b.exe"))
+	e.Check()
+	expect(t, e, applied, "-Profile4", "exact:a.exe")
+	// The held switch to b.exe happens once 'min_dwell' is over.
+	clock.Advance(30 * time.Second)
+	expect(t, e, applied, "-Profile5", "exact:b.exe")
+	clock.Advance(30 * time.Second)
+	src.Set(running("a.exe"))
+	e.Check()
+	expect(t, e, applied, "-Profile3", "exact:a.exe")
+}
+
+// fakeHooks are Hooks whose health the test sets. Ending them is like their message loop quitting.
+type fakeHooks struct {
+	done    chan struct{}
+	once    sync.Once
+	healthy atomic.Bool
+	stopped atomic.Bool
+}
+
+func newFakeHooks(healthy bool) *fakeHooks {
+	h := &fakeHooks{done: make(chan struct{})}
+	h.healthy.Store(healthy)
+	return h
+}
+
+func (h *fakeHooks) end()                  { h.once.Do(func() { close(h.done) }) }
+func (h *fakeHooks) Done() <-chan struct{} { return h.done }
+func (h *fakeHooks) Err() error            { return nil }
+func (h *fakeHooks) Healthy() bool         { return h.healthy.Load() }
+func (h *fakeHooks) Stop()                 { h.stopped.Store(true); h.end() }
+
+// watcherRun is watchEvents running in the background on a 10ms reconcile tick.
+type watcherRun struct {
+	installed chan *fakeHooks
+	result    chan bool
+	cancel    context.CancelFunc
+}
+
+// watch starts watchEvents with the hooks that install makes for the n-th installation, counting from 0.
+func watch(t *testing.T, hybrid bool, install func(n int) *fakeHooks) *watcherRun {
+	t.Helper()
+	e, _, _ := newTestEngine(t, `"reconcile_interval": "10ms"`, watcher.NewFakeSource(running()))
+	w := &watcherRun{installed: make(chan *fakeHooks, 10), result: make(chan bool, 1)}
+	n := 0
+	e.Events = func(handler func([]watcher.Event)) (Hooks, error) {
+		h := install(n)
+		n++
+		w.installed <- h
+		return h, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+	t.Cleanup(cancel)
+	go func() { w.result <- e.watchEvents(ctx, e.cfg, hybrid) }()
+	return w
+}
+
+func (w *watcherRun) next(t *testing.T) *fakeHooks {
+	t.Helper()
+	select {
+	case h := <-w.installed:
+		return h
+	case <-time.After(time.Second):
+		t.Fatal("the hooks were not installed")
+		return nil
+	}
+}
+
+func (w *watcherRun) wait(t *testing.T) bool {
+	t.Helper()
+	select {
+	case ok := <-w.result:
+		return ok
+	case <-time.After(time.Second):
+		t.Fatal("watchEvents did not return")
+		return false
+	}
+}
+
+func TestWatchdogReinstallsEndedHooks(t *testing.T) {
+	w := watch(t, true, func(int) *fakeHooks { return newFakeHooks(true) })
+	w.next(t).end()
+	second := w.next(t)
+	w.cancel()
+	if !w.wait(t) {
+		t.Error("watchEvents fell back to polling after a reinstall")
+	}
+	if !second.stopped.Load() {
+		t.Error("the reinstalled hooks were not stopped on cancel")
+	}
+}
+
+func TestWatchdogReinstallsHooksThatStopDelivering(t *testing.T) {
+	w := watch(t, true, func(n int) *fakeHooks { return newFakeHooks(n > 0) })
+	first := w.next(t)
+	w.next(t)
+	if !first.stopped.Load() {
+		t.Error("the hooks that stopped delivering were not stopped before the reinstall")
+	}
+}
+
+func TestWatchdogFallsBackAfterMaxHookRestarts(t *testing.T) {
+	w := watch(t, true, func(int) *fakeHooks { return newFakeHooks(false) })
+	if w.wait(t) {
+		t.Fatal("watchEvents kept hooks that never deliver")
+	}
+	if got := len(w.installed); got != maxHookRestarts+1 {
+		t.Errorf("installed the hooks %d times, want %d", got, maxHookRestarts+1)
+	}
+}
+
+func TestWatchdogHealthyTickResetsTheRestarts(t *testing.T) {
+	w := watch(t, true, func(int) *fakeHooks { return newFakeHooks(true) })
+	// More failures than maxHookRestarts, each followed by a healthy tick.
+	for i := 0; i < maxHookRestarts+2; i++ {
+		w.next(t).end()
+		time.Sleep(30 * time.Millisecond)
+	}
+	w.next(t)
+	w.cancel()
+	if !w.wait(t) {
+		t.Error("watchEvents gave up on hooks that recovered after every failure")
+	}
+}
+
+func TestWatchEventsStopsTheHooksOnCancel(t *testing.T) {
+	w := watch(t, false, func(int) *fakeHooks { return newFakeHooks(true) })
+	hooks := w.next(t)
+	w.cancel()
+	if !w.wait(t) {
+		t.Error("watchEvents reported a fallback on cancel")
+	}
+	if !hooks.stopped.Load() {
+		t.Error("the hooks were not stopped on cancel")
+	}
+}
+
+func TestNextPoll(t *testing.T) {
+	const fast, slow = time.Second, 10 * time.Second
+	switched := time.Unix(100, 0)
+	tests := []struct {
+		name     string
+		phase    Phase
+		warmup   bool
+		applied  time.Time // appliedAt after the check, the check started at zero
+		interval time.Duration
+		want     time.Duration
+	}{
+		{"idle backs off", PhaseIdle, false, time.Time{}, 2 * time.Second, 4 * time.Second},
+		{"idle stops at slow", PhaseIdle, false, time.Time{}, 8 * time.Second, slow},
+		{"idle stays at slow", PhaseIdle, false, time.Time{}, slow, slow},
+		{"switch resets", PhaseIdle, false, switched, slow, fast},
+		{"target running", PhaseActive, false, time.Time{}, fast, fast},
+		{"warming up", PhaseIdle, true, time.Time{}, 4 * time.Second, fast},
+		{"cooling down", PhaseCooldown, false, time.Time{}, 4 * time.Second, fast},
+	}
+	for _, tt := range tests {
+		e, clock, _ := newTestEngine(t, "", watcher.NewFakeSource(running()))
+		e.phase, e.appliedAt = tt.phase, tt.applied
+		if tt.warmup {
+			e.warmup = clock.AfterFunc(time.Minute, func() {})
+		}
+		if got := e.nextPoll(tt.interval, fast, slow, time.Time{}); got != tt.want {
+			t.Errorf("%s: nextPoll(%s) = %s, want %s", tt.name, tt.interval, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// Package configtest loads configs for the tests of the other packages.
+package configtest
+
+import (
+	"os"
+	"testing"
+
+	"MSIAfterburnerProfileSwitcher/config"
+)
+
+// Base holds the options every test config shares.
+const Base = `"profile_on": "-Profile2", "profile_off": "-Profile1", "notifications": "false", "monitoring_mode": "poll"`
+
+// Load writes a config of the Base options and the given ones, like `"overrides": {"exact:game.exe": "-Profile3"}`,
+// into a temporary working directory and loads it.
+func Load(t testing.TB, options string) config.Config {
+	t.Helper()
+	data := "{" + Base
+	if options != "" {
+		data += ", " + options
+	}
+	data += "}"
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile("MSIAfterburnerProfileSwitcher.json", []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return config.Load()
+}
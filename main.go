@@ -1,14 +1,15 @@
 package main
 
 import (
+	"context"
 	"log"
 	"fmt"
 	"os/exec"
 	"strings"
 	"syscall"
-	"time"
 
 	"MSIAfterburnerProfileSwitcher/config"
+	"MSIAfterburnerProfileSwitcher/engine"
 	"MSIAfterburnerProfileSwitcher/logger"
 	"MSIAfterburnerProfileSwitcher/trayicon"
 	"MSIAfterburnerProfileSwitcher/watcher"
@@ -17,98 +18,53 @@ import (
 	"github.com/gen2brain/beeep"
 )
 
-// runAfterburner executes the MSI Afterburner command.
-func runAfterburner(target, notify, exe, arg string) {
-	cmd := exec.Command(exe, arg)
+// runAfterburner executes the MSI Afterburner command. The title heads the notification.
+func runAfterburner(cfg *config.Config, title, arg string) error {
+	cmd := exec.Command(cfg.AfterburnerPath, arg)
 	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
 
 	arg = strings.TrimLeft(arg, "-Profile")
 	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to launch Afterburner with profile %s: %v", arg, err)
-	} else {
-		log.Printf("Successfully applied profile: %s", arg)
-
-		// Toast Notification
-		notify := strings.ToLower(notify)
-		if notify == "true" {
-			beeep.AppName = "MSI Afterburner Profile Switcher"
-			err := beeep.Notify(
-				fmt.Sprintf("Detected: %s", target),
-				fmt.Sprintf("Applied profile: %s", arg),
-				trayicon.IconData,
-			)
-			if err != nil {
-				log.Printf("Failed to send notification %v", err)
-			}
-		}
-
+		return err
 	}
-}
-
-// checkStateAndApplyProfile is the core logic for determining and applying a profile.
-// It now uses the Overrides map in the config as the sole list of targets.
-func checkStateAndApplyProfile(cfg *config.Config, currentProfile *string) {
-	// The list of targets is now the keys of the Overrides map.
-	// The watcher will prioritize the foreground application.
-	activeTarget, isActive := watcher.FirstActiveTarget(cfg.Overrides)
-
-	var desiredProfile string
-
-	if isActive {
-		profile := cfg.Overrides[activeTarget]
-		if profile != "" {
-			desiredProfile = profile
-		} else {
-			desiredProfile = cfg.ProfileOn
+	log.Printf("Successfully applied profile: %s", arg)
+
+	// Toast Notification
+	notify := strings.ToLower(cfg.Notifications)
+	if notify == "true" {
+		beeep.AppName = "MSI Afterburner Profile Switcher"
+		err := beeep.Notify(
+			title,
+			fmt.Sprintf("Applied profile: %s", arg),
+			trayicon.IconData,
+		)
+		if err != nil {
+			log.Printf("Failed to send notification %v", err)
 		}
-	} else {
-		desiredProfile = cfg.ProfileOff
-	}
-	if activeTarget == "" { activeTarget = "None" }
-
-	if desiredProfile != *currentProfile {
-		log.Printf("Running application detected: '%s', Desired profile: %s", activeTarget, strings.TrimLeft(desiredProfile, "-Profile"))
-		runAfterburner(activeTarget, cfg.Notifications, cfg.AfterburnerPath, desiredProfile)
-		*currentProfile = desiredProfile
 	}
+	return nil
 }
 
-// startPollingMode runs the application by checking for targets on a timer.
-func startPollingMode(cfg config.Config) {
-	log.Println("Starting in Polling Mode")
-	var currentProfile string
-	checkStateAndApplyProfile(&cfg, &currentProfile)
-	ticker := time.NewTicker(time.Duration(cfg.DelaySeconds) * time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		reloadedCfg := config.Load()
-		cfg.ProfileOn = reloadedCfg.ProfileOn
-		cfg.ProfileOff = reloadedCfg.ProfileOff
-		cfg.Overrides = reloadedCfg.Overrides
-		cfg.AfterburnerPath = reloadedCfg.AfterburnerPath
-		cfg.Notifications = reloadedCfg.Notifications
-		checkStateAndApplyProfile(&cfg, &currentProfile)
-	}
+// reloadConfig re-reads the config file. The monitoring mode and delay only change on restart.
+func reloadConfig(cfg config.Config) config.Config {
+	reloadedCfg := config.Load()
+	reloadedCfg.MonitoringMode = cfg.MonitoringMode
+	reloadedCfg.DelaySeconds = cfg.DelaySeconds
+	return reloadedCfg
 }
 
-// startEventMode runs the application by listening for system events.
-func startEventMode(cfg config.Config) {
-	log.Println("Starting in Event-Driven Mode")
-	var currentProfile string
-	eventHandler := func() {
-		reloadedCfg := config.Load()
-		cfg.ProfileOn = reloadedCfg.ProfileOn
-		cfg.ProfileOff = reloadedCfg.ProfileOff
-		cfg.Overrides = reloadedCfg.Overrides
-		cfg.AfterburnerPath = reloadedCfg.AfterburnerPath
-		cfg.Notifications = reloadedCfg.Notifications
-		checkStateAndApplyProfile(&cfg, &currentProfile)
+// startEventWatcher installs the WinEvent hooks for the engine.
+func startEventWatcher(handler func([]watcher.Event)) (engine.Hooks, error) {
+	w, err := watcher.StartEventWatcher(handler)
+	if err != nil {
+		return nil, err
 	}
-	eventHandler()
-	watcher.StartEventWatcher(eventHandler)
-	select {}
+	return w, nil
 }
 
+// switcher is the engine started by onReady.
+var switcher *engine.Engine
+
 func main() {
 	systray.Run(onReady, onExit)
 }
@@ -119,12 +75,15 @@ func onReady() {
 	systray.SetTooltip("MSI Afterburner Profile Switcher is running")
 
 	mLog := systray.AddMenuItem("Show Log", "Open Log Window")
+	mStats := systray.AddMenuItem("Log Event Statistics", "Write the event counters to the log")
 	mQuit := systray.AddMenuItem("Quit", "Quit this app")
 	go func() {
 		for {
 			select {
 			case <-mLog.ClickedCh:
 				logger.OpenOrFocusLogWindow()
+			case <-mStats.ClickedCh:
+				watcher.LogEventStats()
 			case <-mQuit.ClickedCh:
 				systray.Quit()
 				return
@@ -138,14 +97,16 @@ func onReady() {
 	cfg := config.Load()
 	log.Println("Configuration succesfully loaded")
 
-	switch strings.ToLower(cfg.MonitoringMode) {
-	case "poll":
-		startPollingMode(cfg)
-	case "event":
-		startEventMode(cfg)
+	switcher = engine.New(cfg, watcher.NewDetector(), engine.ApplierFunc(runAfterburner))
+	switcher.Reload = reloadConfig
+	switcher.Events = startEventWatcher
+	if err := switcher.Start(context.Background()); err != nil {
+		log.Fatalf("Fatal: Could not start the profile switcher: %v", err)
 	}
 }
 
 func onExit() {
-	//Nothing
+	if switcher != nil {
+		switcher.Stop()
+	}
 }
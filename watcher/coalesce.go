@@ -0,0 +1,128 @@
+package watcher
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventQueueSize bounds the events waiting for the worker. When the queue is full, an event
+// is dropped and the next batch ends with an EventsDropped event instead.
+const eventQueueSize = 256
+
+// eventWindow is how long the worker collects events after the first one before calling the handler.
+const eventWindow = 250 * time.Millisecond
+
+// EventStats counts the events of a Coalescer.
+type EventStats struct {
+	Received  uint64 // events pushed
+	Coalesced uint64 // events handled in the same batch as an earlier one
+	Dropped   uint64 // events that found the queue full
+	Handled   uint64 // batches passed to the handler
+}
+
+// Coalescer hands events to a single worker goroutine. The worker waits a short window after an event
+// and calls the handler once with the batch of everything that arrived in the meantime, so a storm
+// of WinEvents for tooltips and menus costs one check instead of thousands.
+type Coalescer struct {
+	queue  chan Event
+	window time.Duration
+
+	mutex  sync.Mutex // guards closing the queue against a Push
+	closed bool
+
+	received  atomic.Uint64
+	coalesced atomic.Uint64
+	dropped   atomic.Uint64
+	handled   atomic.Uint64
+	overflow  atomic.Bool // events were dropped since the last batch
+}
+
+// NewCoalescer starts a worker that calls handler with the events pushed to it, at most once per window.
+// A batch holds each distinct event once, in the order they arrived.
+func NewCoalescer(window time.Duration, handler func([]Event)) *Coalescer {
+	c := &Coalescer{queue: make(chan Event, eventQueueSize), window: window}
+	go c.run(handler)
+	return c
+}
+
+// Push queues an event without blocking, so it is safe to call from a hook callback.
+// Events pushed after Close are ignored.
+func (c *Coalescer) Push(ev Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return
+	}
+	c.received.Add(1)
+	select {
+	case c.queue <- ev:
+	default:
+		c.dropped.Add(1)
+		c.overflow.Store(true)
+	}
+}
+
+// Close ends the worker once the queued events are handled.
+func (c *Coalescer) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+}
+
+// Stats returns the counters of the events so far.
+func (c *Coalescer) Stats() EventStats {
+	return EventStats{
+		Received:  c.received.Load(),
+		Coalesced: c.coalesced.Load(),
+		Dropped:   c.dropped.Load(),
+		Handled:   c.handled.Load(),
+	}
+}
+
+func (c *Coalescer) run(handler func([]Event)) {
+	for first := range c.queue {
+		batch := []Event{first}
+		seen := map[Event]bool{first: true}
+		deadline := time.NewTimer(c.window)
+	collect:
+		for {
+			select {
+			case ev, ok := <-c.queue:
+				if !ok {
+					break collect
+				}
+				c.coalesced.Add(1)
+				if !seen[ev] {
+					seen[ev] = true
+					batch = append(batch, ev)
+				}
+			case <-deadline.C:
+				break collect
+			}
+		}
+		if c.overflow.Swap(false) {
+			batch = append(batch, Event{Kind: EventsDropped})
+		}
+		c.handled.Add(1)
+		handler(batch)
+	}
+}
+
+// events is the Coalescer of the running event watcher, nil before StartEventWatcher.
+var events atomic.Pointer[Coalescer]
+
+// LogEventStats writes the event counters of the running event watcher to the log.
+func LogEventStats() {
+	c := events.Load()
+	if c == nil {
+		log.Println("Event statistics: no event watcher is running")
+		return
+	}
+	s := c.Stats()
+	log.Printf("Event statistics: %d received, %d coalesced, %d dropped, %d handled", s.Received, s.Coalesced, s.Dropped, s.Handled)
+}
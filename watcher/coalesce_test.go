@@ -0,0 +1,45 @@
+package watcher
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCoalescerBatchesAndDedupes(t *testing.T) {
+	batches := make(chan []Event, 10)
+	c := NewCoalescer(50*time.Millisecond, func(batch []Event) { batches <- batch })
+	defer c.Close()
+	created := Event{Kind: WindowCreated, Window: 1}
+	focus := Event{Kind: ForegroundChanged, Window: 1}
+	for i := 0; i < 100; i++ {
+		c.Push(created)
+		c.Push(focus)
+	}
+	batch := <-batches
+	if !slices.Equal(batch, []Event{created, focus}) {
+		t.Errorf("batch = %v, want each event once", batch)
+	}
+	if s := c.Stats(); s.Received != 200 || s.Coalesced != 199 || s.Handled != 1 {
+		t.Errorf("Stats() = %+v", s)
+	}
+}
+
+func TestCoalescerCloseDuringWindow(t *testing.T) {
+	batches := make(chan []Event, 10)
+	c := NewCoalescer(50*time.Millisecond, func(batch []Event) { batches <- batch })
+	ev := Event{Kind: ProcessStarted, PID: 42}
+	c.Push(ev)
+	c.Close()
+	c.Push(Event{Kind: ProcessExited, PID: 42})
+	c.Close()
+	// The closed queue must not add empty events to the last batch.
+	if batch := <-batches; !slices.Equal(batch, []Event{ev}) {
+		t.Errorf("batch = %v, want only the event pushed before Close", batch)
+	}
+	select {
+	case batch := <-batches:
+		t.Errorf("another batch %v after Close", batch)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
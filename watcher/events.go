@@ -0,0 +1,34 @@
+package watcher
+
+import "fmt"
+
+// EventKind is the kind of change an Event reports.
+type EventKind int
+
+const (
+	ForegroundChanged EventKind = iota // another window got the focus
+	WindowCreated                      // a top-level window was created
+	WindowDestroyed                    // a top-level window was destroyed
+	ProcessStarted                     // a process that started after the watcher showed its first window
+	ProcessExited                      // a process whose last window was destroyed has exited
+	EventsDropped                      // the queue was full, so events of this batch are missing
+)
+
+var eventKindNames = [...]string{"ForegroundChanged", "WindowCreated", "WindowDestroyed", "ProcessStarted", "ProcessExited", "EventsDropped"}
+
+func (k EventKind) String() string {
+	if k < 0 || int(k) >= len(eventKindNames) {
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+	return eventKindNames[k]
+}
+
+// Event is a change on the desktop reported by the event watcher. The hook only records the kind
+// and the window, the worker fills in PID, Exe and Title as far as they can still be read.
+type Event struct {
+	Kind   EventKind
+	Window uintptr // the window handle, 0 for process events
+	PID    int32   // 0 if unknown
+	Exe    string
+	Title  string
+}
@@ -0,0 +1,263 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/shirou/gopsutil/v4/process"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	hookCallbackOnce sync.Once
+	hookCallbackPtr  uintptr
+
+	// current is the EventWatcher whose hooks are installed, the hook callback pushes to it.
+	current atomic.Pointer[EventWatcher]
+)
+
+// EventWatcher is a set of WinEvent hooks and the message loop that delivers their events.
+// Only one EventWatcher runs at a time.
+type EventWatcher struct {
+	coalescer *Coalescer
+	thread    uint32
+	done      chan struct{}
+	err       error // why the message loop ended, set before done is closed
+
+	// foreground is the window of the last foreground event, for Healthy.
+	foreground atomic.Uintptr
+}
+
+// StartEventWatcher sets up Windows event hooks to listen for system events.
+// The hook callback only queues the event, the handler runs on a single worker goroutine
+// and is called once for each burst of events, with the events resolved to their process.
+// The hooks stay installed until Stop is called or their message loop fails.
+func StartEventWatcher(handler func([]Event)) (*EventWatcher, error) {
+	// The worker only calls the handler once an event is pushed, after the tracker is set.
+	var tracker *windowTracker
+	w := &EventWatcher{
+		coalescer: NewCoalescer(eventWindow, func(batch []Event) {
+			handler(tracker.resolve(batch))
+		}),
+		done: make(chan struct{}),
+	}
+	tracker = newWindowTracker(w.coalescer, w.done)
+	fg, _, _ := procGetForegroundWindow.Call()
+	w.foreground.Store(fg)
+	if !current.CompareAndSwap(nil, w) {
+		w.coalescer.Close()
+		return nil, errors.New("an event watcher is already running")
+	}
+	started := make(chan error, 1)
+	go w.run(started)
+	if err := <-started; err != nil {
+		return nil, err
+	}
+	events.Store(w.coalescer)
+	return w, nil
+}
+
+// run installs the hooks and runs their message loop. The hooks belong to the thread that
+// installed them and are delivered through its message loop, so the goroutine keeps its thread.
+func (w *EventWatcher) run(started chan<- error) {
+	runtime.LockOSThread()
+	w.thread = windows.GetCurrentThreadId()
+	hooks, err := installHooks(getHookCallback())
+	if err != nil {
+		current.Store(nil)
+		w.coalescer.Close()
+		started <- err
+		return
+	}
+	// Done must not report the watcher as gone before its hooks are removed and a new one can
+	// take over, so done is closed last. What is pushed to the coalescer once it is closed, like an
+	// exit a tracker still waited for, is ignored.
+	defer func() {
+		for _, hook := range hooks {
+			procUnhookWinEvent.Call(hook)
+		}
+		current.Store(nil)
+		w.coalescer.Close()
+		close(w.done)
+	}()
+
+	// Peeking creates the message queue of the thread, so a WM_QUIT from Stop cannot get lost.
+	var msg struct{ Hwnd, Message, WParam, LParam, Time, Pt uintptr }
+	procPeekMessageW.Call(uintptr(unsafe.Pointer(&msg)), 0, 0, 0, pmNoRemove)
+	started <- nil
+	for {
+		ret, _, err := procGetMessageW.Call(uintptr(unsafe.Pointer(&msg)), 0, 0, 0)
+		if int32(ret) == -1 {
+			w.err = fmt.Errorf("message loop failed: %v", err)
+			return
+		}
+		if ret == 0 {
+			// WM_QUIT
+			return
+		}
+		procTranslateMessage.Call(uintptr(unsafe.Pointer(&msg)))
+		procDispatchMessageW.Call(uintptr(unsafe.Pointer(&msg)))
+	}
+}
+
+// installHooks sets the foreground and create/destroy hooks on the current thread.
+// If one of them fails, the ones already set are removed again.
+func installHooks(cb uintptr) ([]uintptr, error) {
+	ranges := []struct {
+		min, max uintptr
+		name     string
+	}{
+		{eventSystemForeground, eventSystemForeground, "foreground"},
+		{eventObjectCreate, eventObjectDestroy, "create/destroy"},
+	}
+	var hooks []uintptr
+	for _, r := range ranges {
+		hook, _, err := procSetWinEventHook.Call(r.min, r.max, 0, cb, 0, 0, uintptr(wndOutofcontext))
+		if hook == 0 {
+			for _, hook := range hooks {
+				procUnhookWinEvent.Call(hook)
+			}
+			return nil, fmt.Errorf("could not set %s event hook: %v", r.name, err)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// getHookCallback returns the WinEvent callback. Callbacks are never freed, so there is only one
+// for all event watchers and it pushes to the current one.
+func getHookCallback() uintptr {
+	hookCallbackOnce.Do(func() {
+		hookCallbackPtr = syscall.NewCallback(func(hWinEventHook syscall.Handle, event uint32, hwnd syscall.Handle, idObject int32, idChild int32, idEventThread uint32, dwmsEventTime uint32) uintptr {
+			w := current.Load()
+			if w == nil {
+				return 0
+			}
+			switch event {
+			case eventSystemForeground:
+				w.foreground.Store(uintptr(hwnd))
+				w.coalescer.Push(Event{Kind: ForegroundChanged, Window: uintptr(hwnd)})
+			case eventObjectCreate, eventObjectDestroy:
+				// Only windows themselves, not the carets, cursors and scroll bars inside them.
+				if idObject != objidWindow || idChild != childidSelf {
+					return 0
+				}
+				kind := WindowCreated
+				if event == eventObjectDestroy {
+					kind = WindowDestroyed
+				}
+				w.coalescer.Push(Event{Kind: kind, Window: uintptr(hwnd)})
+			}
+			return 0
+		})
+	})
+	return hookCallbackPtr
+}
+
+// Done is closed when the message loop has ended, after Stop or because it failed.
+func (w *EventWatcher) Done() <-chan struct{} {
+	return w.done
+}
+
+// Err waits for Done and returns why the message loop failed, nil if it was stopped.
+func (w *EventWatcher) Err() error {
+	<-w.done
+	return w.err
+}
+
+// Healthy reports whether the hooks still deliver events: the foreground window is the one
+// of the last foreground event. Right after a focus change it may briefly report false.
+func (w *EventWatcher) Healthy() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	fg, _, _ := procGetForegroundWindow.Call()
+	// No foreground window, like on the lock screen, does not send an event.
+	return fg == 0 || fg == w.foreground.Load()
+}
+
+// Stop removes the hooks and ends the message loop.
+func (w *EventWatcher) Stop() {
+	select {
+	case <-w.done:
+		return
+	default:
+	}
+	procPostThreadMessageW.Call(uintptr(w.thread), wmQuit, 0, 0)
+	<-w.done
+}
+
+// exitPollInterval is how often a wait for a process to exit checks whether the watcher has stopped.
+const exitPollInterval = time.Second
+
+// newWindowTracker remembers the running processes, so their windows do not count as a process start,
+// and the windows they show, so closing them can tell when a process started before the watcher exits.
+// The exits it waits for are pushed to c until done is closed.
+func newWindowTracker(c *Coalescer, done <-chan struct{}) *windowTracker {
+	t := &windowTracker{
+		known:       make(map[int32]bool),
+		windows:     make(map[uintptr]int32),
+		count:       make(map[int32]int),
+		exiting:     make(map[int32]bool),
+		windowPID:   windowPID,
+		windowTitle: func(hwnd uintptr) string { return getWindowText(windows.HWND(hwnd)) },
+		exePath:     func(pid int32) string { return getProcessExePath(uint32(pid)) },
+		running:     processRunning,
+		awaitExit:   func(pid int32) { go awaitExit(pid, c, done) },
+	}
+	pids, _ := process.Pids()
+	for _, pid := range pids {
+		t.known[pid] = true
+	}
+	wins, _ := win32Source{}.Windows()
+	for _, win := range wins {
+		t.track(win.Handle, win.PID)
+	}
+	return t
+}
+
+// awaitExit pushes a ProcessExited event once the process has exited, unless done is closed first.
+func awaitExit(pid int32, c *Coalescer, done <-chan struct{}) {
+	handle, err := windows.OpenProcess(windows.SYNCHRONIZE, false, uint32(pid))
+	if err == nil {
+		defer windows.CloseHandle(handle)
+		for {
+			event, err := windows.WaitForSingleObject(handle, uint32(exitPollInterval.Milliseconds()))
+			if err != nil || event != uint32(windows.WAIT_TIMEOUT) {
+				break
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}
+	c.Push(Event{Kind: ProcessExited, PID: pid})
+}
+
+// windowPID returns the pid of the process that owns a window, 0 if the window is gone.
+func windowPID(hwnd uintptr) int32 {
+	var pid uint32
+	procGetWindowThreadProcessId.Call(hwnd, uintptr(unsafe.Pointer(&pid)))
+	return int32(pid)
+}
+
+// processRunning reports whether the process with the given pid has not exited yet.
+func processRunning(pid int32) bool {
+	handle, err := windows.OpenProcess(windows.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(handle)
+	event, err := windows.WaitForSingleObject(handle, 0)
+	return err == nil && event == uint32(windows.WAIT_TIMEOUT)
+}
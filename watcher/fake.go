@@ -0,0 +1,97 @@
+package watcher
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Snapshot is the desktop state a FakeSource reports at one point in time.
+// A nil Foreground means no window has the focus. The maps are keyed by pid.
+type Snapshot struct {
+	Processes  []Process
+	Windows    []Window
+	Foreground *Foreground
+	Environs   map[int32][]string
+	Modules    map[int32][]string
+	Usages     map[int32]Usage
+}
+
+// FakeSource is an in-memory ProcessSource, WindowSource, ForegroundSource,
+// EnvironSource, ModuleSource and UsageSource.
+// It replays a script of snapshots, so the matching pipeline can run without a desktop.
+type FakeSource struct {
+	mutex     sync.Mutex
+	snapshots []Snapshot
+	current   int
+}
+
+// NewFakeSource returns a FakeSource that starts at the first of the given snapshots.
+func NewFakeSource(snapshots ...Snapshot) *FakeSource {
+	return &FakeSource{snapshots: snapshots}
+}
+
+// Detector returns a Detector that reads all its sources from f.
+func (f *FakeSource) Detector() *Detector {
+	return &Detector{Processes: f, Windows: f, Foreground: f, Environs: f, Modules: f, Usages: f}
+}
+
+// Set replaces the script with a single snapshot.
+func (f *FakeSource) Set(s Snapshot) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.snapshots = []Snapshot{s}
+	f.current = 0
+}
+
+// Advance moves to the next snapshot of the script.
+// It returns false and stays on the last snapshot when the script is exhausted.
+func (f *FakeSource) Advance() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.current+1 >= len(f.snapshots) {
+		return false
+	}
+	f.current++
+	return true
+}
+
+func (f *FakeSource) snapshot() Snapshot {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.snapshots) == 0 {
+		return Snapshot{}
+	}
+	return f.snapshots[f.current]
+}
+
+func (f *FakeSource) Processes() ([]Process, error) {
+	return append([]Process(nil), f.snapshot().Processes...), nil
+}
+
+func (f *FakeSource) Windows() ([]Window, error) {
+	return append([]Window(nil), f.snapshot().Windows...), nil
+}
+
+func (f *FakeSource) Foreground() (Foreground, bool) {
+	fg := f.snapshot().Foreground
+	if fg == nil {
+		return Foreground{}, false
+	}
+	return *fg, true
+}
+
+func (f *FakeSource) Environ(pid int32) ([]string, error) {
+	return f.snapshot().Environs[pid], nil
+}
+
+func (f *FakeSource) Modules(pid int32) ([]string, error) {
+	return f.snapshot().Modules[pid], nil
+}
+
+func (f *FakeSource) Usage(pid int32) (Usage, error) {
+	u, ok := f.snapshot().Usages[pid]
+	if !ok {
+		return Usage{}, fmt.Errorf("no usage for pid %d", pid)
+	}
+	return u, nil
+}
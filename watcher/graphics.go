@@ -0,0 +1,100 @@
+package watcher
+
+import (
+	"strings"
+	"time"
+
+	"MSIAfterburnerProfileSwitcher/config"
+)
+
+// AutoDetectPrefix starts the match key of a process found by auto-detection, e.g. "auto:game.exe".
+// No override has such a key, so the target gets 'profile_on'.
+const AutoDetectPrefix = "auto:"
+
+// Libraries that mark a process as a 3D application. Windows DLLs are compared by name,
+// Linux shared objects by prefix because the name carries the version.
+var (
+	graphicsDLLs = []string{"d3d11.dll", "d3d12.dll", "vulkan-1.dll"}
+	graphicsSOs  = []string{"libvulkan.so", "libgl.so", "libglx.so"}
+)
+
+// graphicsRecheck is how long a process without graphics libraries is left alone before
+// its modules are listed again. A process with graphics libraries is not listed again.
+const graphicsRecheck = time.Minute
+
+// graphicsEntry caches whether a process has a graphics library loaded.
+type graphicsEntry struct {
+	createTime int64 // tells a new process with a reused pid apart
+	loaded     bool
+	checked    time.Time
+}
+
+// isGraphicsActive checks if any running process has a 3D graphics API loaded, when 'auto_detect' is enabled.
+// With the foreground-only policy only the foreground process is checked.
+func (s *scan) isGraphicsActive() []Match {
+	auto := s.cfg.AutoDetect
+	if !auto.IsEnabled() || s.detector.Modules == nil {
+		return nil
+	}
+	processes, err := s.processList()
+	if err != nil {
+		return nil
+	}
+	if s.detector.graphics == nil {
+		s.detector.graphics = make(map[int32]graphicsEntry)
+	}
+	running := make(map[int32]bool, len(processes))
+	var matches []Match
+	for _, p := range processes {
+		running[p.PID] = true
+		if s.cfg.ForegroundPolicy == config.PolicyForegroundOnly && p.PID != s.foregroundPID {
+			continue
+		}
+		if s.cfg.Exclude.MatchesProcess(p.Name) || auto.Excludes(p.Name) {
+			continue
+		}
+		if min := auto.MinRuntimeDuration(); min > 0 && !s.ranFor(p.PID, min) {
+			continue
+		}
+		if s.loadsGraphics(p) {
+			matches = append(matches, Match{Key: AutoDetectPrefix + strings.ToLower(p.Name), Foreground: p.PID == s.foregroundPID, PID: p.PID, CreateTime: s.createTime(p.PID)})
+		}
+	}
+	for pid := range s.detector.graphics {
+		if !running[pid] {
+			delete(s.detector.graphics, pid)
+		}
+	}
+	return matches
+}
+
+// loadsGraphics reports whether p has a graphics library loaded, using the cache of the Detector.
+func (s *scan) loadsGraphics(p Process) bool {
+	createTime := s.createTime(p.PID)
+	entry, ok := s.detector.graphics[p.PID]
+	if ok && entry.createTime == createTime && (entry.loaded || s.now.Sub(entry.checked) < graphicsRecheck) {
+		return entry.loaded
+	}
+	modules, _ := s.detector.Modules.Modules(p.PID)
+	entry = graphicsEntry{createTime: createTime, loaded: hasGraphicsLibrary(modules), checked: s.now}
+	s.detector.graphics[p.PID] = entry
+	return entry.loaded
+}
+
+// hasGraphicsLibrary reports whether any of the module paths is a graphics library.
+func hasGraphicsLibrary(modules []string) bool {
+	for _, module := range modules {
+		name := strings.ToLower(windowsBase(module))
+		for _, dll := range graphicsDLLs {
+			if name == dll {
+				return true
+			}
+		}
+		for _, so := range graphicsSOs {
+			if strings.HasPrefix(name, so) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package watcher
+
+import (
+	"path"
+	"strings"
+)
+
+// commLen is the length Linux truncates /proc/<pid>/comm to.
+const commLen = 15
+
+// wineLoaders are the executables a Wine or Proton process runs as before it renames itself.
+var wineLoaders = []string{"wine", "wine64", "wine-preloader", "wine64-preloader"}
+
+// resolveIdentity recovers the name a process would have on Windows.
+// For Wine and Proton processes the Windows executable is taken from the command line,
+// for everything else a truncated comm name is completed from the executable path.
+func resolveIdentity(p Process) Process {
+	if winExe, ok := wineExecutable(p); ok {
+		p.Name = windowsBase(winExe)
+		p.Exe = unixPath(winExe)
+		return p
+	}
+	if len(p.Name) == commLen {
+		for _, candidate := range []string{p.Exe, firstArg(p.Args)} {
+			base := path.Base(candidate)
+			if candidate != "" && len(base) > commLen && strings.HasPrefix(base, p.Name) {
+				p.Name = base
+				break
+			}
+		}
+	}
+	return p
+}
+
+// wineExecutable returns the Windows executable path of a Wine process.
+// Wine rewrites argv[0] to the Windows path once the program is loaded, before that
+// the loader is argv[0] and the program follows as one of the next arguments.
+func wineExecutable(p Process) (string, bool) {
+	if len(p.Args) == 0 {
+		return "", false
+	}
+	if isWindowsExe(p.Args[0]) {
+		return p.Args[0], true
+	}
+	if !isWineLoader(p.Exe) && !isWineLoader(p.Args[0]) {
+		return "", false
+	}
+	for _, arg := range p.Args[1:] {
+		if isWindowsExe(arg) {
+			return arg, true
+		}
+	}
+	return "", false
+}
+
+func isWineLoader(file string) bool {
+	base := path.Base(file)
+	for _, loader := range wineLoaders {
+		if base == loader {
+			return true
+		}
+	}
+	return false
+}
+
+func isWindowsExe(arg string) bool {
+	return strings.HasSuffix(strings.ToLower(arg), ".exe")
+}
+
+// windowsBase returns the last element of a path that may use either separator.
+func windowsBase(p string) string {
+	if i := strings.LastIndexAny(p, `\/`); i >= 0 {
+		return p[i+1:]
+	}
+	return p
+}
+
+// unixPath maps a path on Wine's Z: drive back to the host filesystem.
+// Paths on other drives are returned unchanged.
+func unixPath(p string) string {
+	if len(p) >= 3 && (p[0] == 'z' || p[0] == 'Z') && p[1] == ':' && (p[2] == '\\' || p[2] == '/') {
+		return strings.ReplaceAll(p[2:], `\`, "/")
+	}
+	return p
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
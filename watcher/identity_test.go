@@ -0,0 +1,73 @@
+package watcher
+
+import "testing"
+
+func TestResolveIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       Process
+		wantName string
+		wantExe  string
+	}{
+		{
+			name:     "proton game after wine renamed argv[0]",
+			in:       Process{Name: "Cyberpunk2077.e", Exe: "/usr/bin/wine64-preloader", Args: []string{`Z:\games\Cyberpunk 2077\bin\x64\Cyberpunk2077.exe`, "--launcher-skip"}},
+			wantName: "Cyberpunk2077.exe",
+			wantExe:  "/games/Cyberpunk 2077/bin/x64/Cyberpunk2077.exe",
+		},
+		{
+			name:     "loader still in argv[0]",
+			in:       Process{Name: "wine64-preloade", Exe: "/opt/proton/files/bin/wine64-preloader", Args: []string{"/opt/proton/files/bin/wine64-preloader", `C:\Program Files\Game\game.exe`}},
+			wantName: "game.exe",
+			wantExe:  `C:\Program Files\Game\game.exe`,
+		},
+		{
+			name:     "wine loader found by argv[0] only",
+			in:       Process{Name: "wine", Args: []string{"wine", "-debug", "setup.exe"}},
+			wantName: "setup.exe",
+			wantExe:  "setup.exe",
+		},
+		{
+			name:     "Z: drive with forward slashes",
+			in:       Process{Name: "game.exe", Args: []string{"z:/home/user/game.exe"}},
+			wantName: "game.exe",
+			wantExe:  "/home/user/game.exe",
+		},
+		{
+			name:     "native comm cut to 15 characters, completed from exe",
+			in:       Process{Name: "deadisland-win6", Exe: "/games/DeadIsland/deadisland-win64-shipping.exe"},
+			wantName: "deadisland-win64-shipping.exe",
+			wantExe:  "/games/DeadIsland/deadisland-win64-shipping.exe",
+		},
+		{
+			name:     "truncated comm completed from argv[0] when exe is unreadable",
+			in:       Process{Name: "supertuxkart-bi", Args: []string{"/usr/games/supertuxkart-binary", "--fullscreen"}},
+			wantName: "supertuxkart-binary",
+		},
+		{
+			name:     "15 characters that are not a prefix of the exe stay as they are",
+			in:       Process{Name: "Isolated Web Co", Exe: "/usr/lib/firefox/firefox"},
+			wantName: "Isolated Web Co",
+			wantExe:  "/usr/lib/firefox/firefox",
+		},
+		{
+			name:     "native process with an .exe argument is not wine",
+			in:       Process{Name: "bash", Exe: "/usr/bin/bash", Args: []string{"bash", "run.exe"}},
+			wantName: "bash",
+			wantExe:  "/usr/bin/bash",
+		},
+		{
+			name:     "no command line",
+			in:       Process{Name: "kworker/0:1"},
+			wantName: "kworker/0:1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := resolveIdentity(tt.in)
+			if got.Name != tt.wantName || got.Exe != tt.wantExe {
+				t.Errorf("resolveIdentity() = %q, %q, want %q, %q", got.Name, got.Exe, tt.wantName, tt.wantExe)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"time"
+
+	"github.com/shirou/gopsutil/v4/process"
+)
+
+// gopsutilSource lists processes through gopsutil. Every property of a process opens it on Windows,
+// so the list only carries the names and the rest is read for the processes a scan needs.
+type gopsutilSource struct{}
+
+func (gopsutilSource) Processes() ([]Process, error) {
+	processes, err := process.Processes()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Process, 0, len(processes))
+	for _, p := range processes {
+		name, err := p.Name()
+		if err != nil {
+			continue
+		}
+		result = append(result, Process{PID: p.Pid, Name: name})
+	}
+	return result, nil
+}
+
+func (gopsutilSource) Cmdline(pid int32) ([]string, error) {
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	return p.CmdlineSlice()
+}
+
+func (gopsutilSource) Parent(pid int32) (int32, error) {
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return 0, err
+	}
+	return p.Ppid()
+}
+
+// Exe fails for protected system processes, the name is enough for them.
+func (gopsutilSource) Exe(pid int32) (string, error) {
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return "", err
+	}
+	return p.Exe()
+}
+
+func (gopsutilSource) CreateTime(pid int32) (int64, error) {
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return 0, err
+	}
+	return p.CreateTime()
+}
+
+func (gopsutilSource) Environ(pid int32) ([]string, error) {
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	return p.Environ()
+}
+
+func (gopsutilSource) Usage(pid int32) (Usage, error) {
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return Usage{}, err
+	}
+	mem, err := p.MemoryInfo()
+	if err != nil {
+		return Usage{}, err
+	}
+	times, err := p.Times()
+	if err != nil {
+		return Usage{}, err
+	}
+	cpuTime := time.Duration((times.User + times.System) * float64(time.Second))
+	return Usage{CPUTime: cpuTime, RSS: mem.RSS}, nil
+}
@@ -0,0 +1,141 @@
+package watcher
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// clockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat. It is 100 on all supported architectures.
+const clockTicks = 100
+
+// procSource lists processes by reading a procfs tree such as /proc.
+type procSource struct {
+	root string
+}
+
+// Processes reads comm, exe, cmdline and stat of every numeric entry below root and
+// resolves the Windows identity of Wine and Proton processes.
+// Processes that exit during the scan or cannot be read are skipped.
+func (s procSource) Processes() ([]Process, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	bootTime := s.bootTime()
+	result := make([]Process, 0, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.ParseInt(entry.Name(), 10, 32)
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		p, ok := s.readProcess(int32(pid), bootTime)
+		if !ok {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+func (s procSource) readProcess(pid int32, bootTime int64) (Process, bool) {
+	dir := filepath.Join(s.root, strconv.Itoa(int(pid)))
+	comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return Process{}, false
+	}
+	p := Process{PID: pid, Name: strings.TrimSuffix(string(comm), "\n")}
+	// exe is unreadable for kernel threads and for processes of other users.
+	if exe, err := os.Readlink(filepath.Join(dir, "exe")); err == nil {
+		p.Exe = strings.TrimSuffix(exe, " (deleted)")
+	}
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		p.Args = splitCmdline(cmdline)
+	}
+	if stat, err := os.ReadFile(filepath.Join(dir, "stat")); err == nil {
+		if fields := statFields(stat); len(fields) > 19 {
+			if ppid, err := strconv.ParseInt(fields[1], 10, 32); err == nil {
+				p.PPID = int32(ppid)
+			}
+			if start, err := strconv.ParseInt(fields[19], 10, 64); err == nil && bootTime > 0 {
+				p.CreateTime = bootTime*1000 + start*1000/clockTicks
+			}
+		}
+	}
+	return resolveIdentity(p), true
+}
+
+// Environ reads the NUL separated entries of <root>/<pid>/environ.
+// Only processes of the same user, or all of them as root, can be read.
+func (s procSource) Environ(pid int32) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(s.root, strconv.Itoa(int(pid)), "environ"))
+	if err != nil {
+		return nil, err
+	}
+	return splitCmdline(data), nil
+}
+
+// Modules lists the files mapped into a process from <root>/<pid>/maps, each file once.
+func (s procSource) Modules(pid int32) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(s.root, strconv.Itoa(int(pid)), "maps"))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var modules []string
+	for _, line := range strings.Split(string(data), "\n") {
+		// address perms offset dev inode pathname, the pathname may contain spaces.
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+		file := strings.TrimSpace(fields[5])
+		if !strings.HasPrefix(file, "/") || seen[file] {
+			continue
+		}
+		seen[file] = true
+		modules = append(modules, file)
+	}
+	return modules, nil
+}
+
+// bootTime returns the boot time in seconds since the epoch from the btime line of <root>/stat, or 0.
+func (s procSource) bootTime() int64 {
+	data, err := os.ReadFile(filepath.Join(s.root, "stat"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "btime "); ok {
+			bootTime, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			return bootTime
+		}
+	}
+	return 0
+}
+
+// statFields splits /proc/<pid>/stat after the command name, which may contain spaces and parentheses.
+// The first returned field is the state, field 3 in proc(5).
+func statFields(data []byte) []string {
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return nil
+	}
+	return strings.Fields(string(data[i+1:]))
+}
+
+// splitCmdline splits the NUL separated contents of /proc/<pid>/cmdline or environ.
+func splitCmdline(data []byte) []string {
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil
+	}
+	parts := bytes.Split(data, []byte{0})
+	args := make([]string, len(parts))
+	for i, part := range parts {
+		args[i] = string(part)
+	}
+	return args
+}
@@ -0,0 +1,118 @@
+package watcher
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"MSIAfterburnerProfileSwitcher/internal/configtest"
+)
+
+// startChild starts a process that sleeps until the test ends.
+func startChild(t *testing.T, env []string, name string, args ...string) int32 {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Env = env
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start %s: %v", name, err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return int32(cmd.Process.Pid)
+}
+
+// countingEnvirons counts the environment reads per pid.
+type countingEnvirons struct {
+	procSource
+	reads map[int32]int
+}
+
+func (c *countingEnvirons) Environ(pid int32) ([]string, error) {
+	c.reads[pid]++
+	return c.procSource.Environ(pid)
+}
+
+func TestAppIDFromChildEnvironment(t *testing.T) {
+	cfg := configtest.Load(t, `"overrides": {"appid:1091500": "-Profile3"}`)
+	pid := startChild(t, append(os.Environ(), "SteamAppId=1091500"), "sleep", "60")
+	source := procSource{root: "/proc"}
+	environs := &countingEnvirons{procSource: source, reads: make(map[int32]int)}
+	d := &Detector{Processes: source, Environs: environs}
+	for i := 0; i < 3; i++ {
+		matches := d.ActiveTargets(&cfg)
+		if len(matches) != 1 || matches[0].Key != "appid:1091500" || matches[0].PID != pid {
+			t.Fatalf("scan %d: ActiveTargets = %+v, want the child %d", i, matches, pid)
+		}
+	}
+	if n := environs.reads[pid]; n != 1 {
+		t.Errorf("the environment of the child was read %d times, want once", n)
+	}
+}
+
+func TestAppIDFromSteamGameId(t *testing.T) {
+	cfg := configtest.Load(t, `"overrides": {"appid:480": "-Profile3"}`)
+	// SteamAppId=0 is what Steam sets for shortcuts to games it does not sell, the id is then in SteamGameId.
+	pid := startChild(t, []string{"SteamAppId=0", "SteamGameId=480"}, "sleep", "60")
+	source := procSource{root: "/proc"}
+	d := &Detector{Processes: source, Environs: source}
+	matches := d.ActiveTargets(&cfg)
+	if len(matches) != 1 || matches[0].PID != pid {
+		t.Fatalf("ActiveTargets = %+v, want the child %d", matches, pid)
+	}
+}
+
+// graphicsLibraries are the libraries a test child can preload to look like a 3D application.
+var graphicsLibraries = []string{"libGL.so.1", "libvulkan.so.1"}
+
+// startGraphicsChild starts a sleeping process named name with a graphics library preloaded.
+// It skips the test when no graphics library is installed.
+func startGraphicsChild(t *testing.T, name string) int32 {
+	t.Helper()
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	// The process is named after the file it runs, so a link gives it the name.
+	link := filepath.Join(t.TempDir(), name)
+	if err := os.Symlink(sleep, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, lib := range graphicsLibraries {
+		pid := startChild(t, append(os.Environ(), "LD_PRELOAD="+lib), link, "60")
+		// The loader maps the preloaded library before main, wait until it is done.
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			modules, _ := procSource{root: "/proc"}.Modules(pid)
+			if hasGraphicsLibrary(modules) {
+				return pid
+			}
+		}
+	}
+	t.Skip("no graphics library to preload")
+	return 0
+}
+
+func TestAutoDetectChildWithGraphicsLibrary(t *testing.T) {
+	cfg := configtest.Load(t, `"auto_detect": {"enabled": "true", "min_runtime": "0s"}`)
+	game := startGraphicsChild(t, "mygame")
+	desktop := startGraphicsChild(t, "gnome-shell")
+	plain := startChild(t, os.Environ(), "sleep", "60")
+	source := procSource{root: "/proc"}
+	d := &Detector{Processes: source, Modules: source}
+	found := make(map[int32]string)
+	for _, m := range d.ActiveTargets(&cfg) {
+		found[m.PID] = m.Key
+	}
+	if key := found[game]; key != AutoDetectPrefix+"mygame" {
+		t.Errorf("the child with a graphics library matched as %q, want %q", key, AutoDetectPrefix+"mygame")
+	}
+	if key, ok := found[desktop]; ok {
+		t.Errorf("the excluded gnome-shell child matched as %q", key)
+	}
+	if key, ok := found[plain]; ok {
+		t.Errorf("the child without a graphics library matched as %q", key)
+	}
+}
@@ -0,0 +1,92 @@
+package watcher
+
+// windowTracker resolves the raw hook events of a batch on the worker goroutine.
+// It remembers the process of every window it saw, so it can tell when a new process shows
+// its first window and when a process whose last window is gone has exited.
+type windowTracker struct {
+	known   map[int32]bool    // processes that ran when the watcher started or showed a window since
+	windows map[uintptr]int32 // tracked windows by handle, with their pid
+	count   map[int32]int     // number of tracked windows per pid
+	exiting map[int32]bool    // processes whose last window is gone but that still ran
+
+	// The system calls behind the tracker, replaced in tests.
+	windowPID   func(hwnd uintptr) int32 // 0 if the window is gone
+	windowTitle func(hwnd uintptr) string
+	exePath     func(pid int32) string
+	running     func(pid int32) bool
+	// awaitExit makes a ProcessExited event for pid arrive in a later batch once the process has exited.
+	awaitExit func(pid int32)
+}
+
+// track remembers a window of a process, once.
+func (t *windowTracker) track(hwnd uintptr, pid int32) {
+	if _, tracked := t.windows[hwnd]; tracked {
+		return
+	}
+	t.windows[hwnd] = pid
+	t.count[pid]++
+	delete(t.exiting, pid)
+}
+
+// resolve fills in the pid, exe and title of the events and adds the process events they imply.
+// Windows that are already gone again when the batch is handled, like most tooltips, are left out.
+func (t *windowTracker) resolve(batch []Event) []Event {
+	var out []Event
+	for _, ev := range batch {
+		switch ev.Kind {
+		case ForegroundChanged:
+			ev.PID = t.windowPID(ev.Window)
+			ev.Title = t.windowTitle(ev.Window)
+			if ev.PID != 0 {
+				ev.Exe = t.exePath(ev.PID)
+				t.track(ev.Window, ev.PID)
+			}
+			out = append(out, ev)
+		case WindowCreated:
+			ev.PID = t.windowPID(ev.Window)
+			if ev.PID == 0 {
+				continue
+			}
+			ev.Title = t.windowTitle(ev.Window)
+			ev.Exe = t.exePath(ev.PID)
+			t.track(ev.Window, ev.PID)
+			if !t.known[ev.PID] {
+				t.known[ev.PID] = true
+				out = append(out, Event{Kind: ProcessStarted, PID: ev.PID, Exe: ev.Exe})
+			}
+			out = append(out, ev)
+		case WindowDestroyed:
+			pid, tracked := t.windows[ev.Window]
+			ev.PID = pid
+			out = append(out, ev)
+			if !tracked {
+				continue
+			}
+			delete(t.windows, ev.Window)
+			t.count[pid]--
+			if t.count[pid] > 0 {
+				continue
+			}
+			delete(t.count, pid)
+			if t.running(pid) {
+				// A game often closes its window before it is done shutting down.
+				t.exiting[pid] = true
+				t.awaitExit(pid)
+				continue
+			}
+			delete(t.known, pid)
+			out = append(out, Event{Kind: ProcessExited, PID: pid})
+		case ProcessExited:
+			// From awaitExit. A process that showed a window again in the meantime has not exited.
+			if !t.exiting[ev.PID] {
+				continue
+			}
+			delete(t.exiting, ev.PID)
+			delete(t.known, ev.PID)
+			out = append(out, ev)
+		default:
+			out = append(out, ev)
+		}
+	}
+	return out
+}
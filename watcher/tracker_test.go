@@ -0,0 +1,104 @@
+package watcher
+
+import (
+	"slices"
+	"testing"
+)
+
+// fakeDesktop backs a windowTracker with windows and processes that tests change between batches.
+type fakeDesktop struct {
+	windows map[uintptr]int32
+	running map[int32]bool
+	awaited []int32
+}
+
+func (d *fakeDesktop) tracker() *windowTracker {
+	return &windowTracker{
+		known:       map[int32]bool{},
+		windows:     map[uintptr]int32{},
+		count:       map[int32]int{},
+		exiting:     map[int32]bool{},
+		windowPID:   func(hwnd uintptr) int32 { return d.windows[hwnd] },
+		windowTitle: func(hwnd uintptr) string { return "" },
+		exePath:     func(pid int32) string { return "" },
+		running:     func(pid int32) bool { return d.running[pid] },
+		awaitExit:   func(pid int32) { d.awaited = append(d.awaited, pid) },
+	}
+}
+
+// processEvents returns the process events of a resolved batch.
+func processEvents(batch []Event) []Event {
+	var out []Event
+	for _, ev := range batch {
+		if ev.Kind == ProcessStarted || ev.Kind == ProcessExited {
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+func TestTrackerWaitsForAProcessThatOutlivesItsWindow(t *testing.T) {
+	d := &fakeDesktop{windows: map[uintptr]int32{1: 7}, running: map[int32]bool{7: true}}
+	tr := d.tracker()
+	got := processEvents(tr.resolve([]Event{{Kind: WindowCreated, Window: 1}}))
+	if !slices.Equal(got, []Event{{Kind: ProcessStarted, PID: 7}}) {
+		t.Fatalf("create: process events = %v, want the start of 7", got)
+	}
+
+	// The window closes while the game is still shutting down.
+	delete(d.windows, 1)
+	batch := tr.resolve([]Event{{Kind: WindowDestroyed, Window: 1}})
+	if !slices.Equal(batch, []Event{{Kind: WindowDestroyed, Window: 1, PID: 7}}) {
+		t.Errorf("destroy: batch = %v, want only the destroy of the window of 7", batch)
+	}
+	if !slices.Equal(d.awaited, []int32{7}) {
+		t.Fatalf("awaited = %v, want a wait for the exit of 7", d.awaited)
+	}
+
+	// awaitExit reports the exit in a later batch.
+	delete(d.running, 7)
+	got = processEvents(tr.resolve([]Event{{Kind: ProcessExited, PID: 7}}))
+	if !slices.Equal(got, []Event{{Kind: ProcessExited, PID: 7}}) {
+		t.Errorf("exit: process events = %v, want the exit of 7", got)
+	}
+	if tr.known[7] {
+		t.Error("7 is still known after its exit, a new process with its pid would not count as a start")
+	}
+}
+
+func TestTrackerDropsTheExitOfAProcessThatShowedAWindowAgain(t *testing.T) {
+	d := &fakeDesktop{windows: map[uintptr]int32{1: 7}, running: map[int32]bool{7: true}}
+	tr := d.tracker()
+	tr.resolve([]Event{{Kind: WindowCreated, Window: 1}})
+	delete(d.windows, 1)
+	tr.resolve([]Event{{Kind: WindowDestroyed, Window: 1}})
+	// A launcher that replaces its splash screen with the main window.
+	d.windows[2] = 7
+	tr.resolve([]Event{{Kind: WindowCreated, Window: 2}})
+	if got := processEvents(tr.resolve([]Event{{Kind: ProcessExited, PID: 7}})); got != nil {
+		t.Errorf("process events = %v, want none while 7 has a window", got)
+	}
+}
+
+func TestTrackerExitOfAProcessThatStartedBeforeIt(t *testing.T) {
+	d := &fakeDesktop{windows: map[uintptr]int32{1: 7}, running: map[int32]bool{}}
+	tr := d.tracker()
+	// Seeded from the windows at start, or learned from a focus change.
+	tr.known[7] = true
+	tr.track(1, 7)
+	delete(d.windows, 1)
+	got := processEvents(tr.resolve([]Event{{Kind: WindowDestroyed, Window: 1}}))
+	if !slices.Equal(got, []Event{{Kind: ProcessExited, PID: 7}}) {
+		t.Errorf("process events = %v, want the exit of 7", got)
+	}
+
+	d.windows[2] = 8
+	d.running[8] = true
+	tr.resolve([]Event{{Kind: ForegroundChanged, Window: 2}})
+	delete(d.windows, 2)
+	delete(d.running, 8)
+	got = processEvents(tr.resolve([]Event{{Kind: WindowDestroyed, Window: 2}}))
+	if !slices.Equal(got, []Event{{Kind: ProcessExited, PID: 8}}) {
+		t.Errorf("process events = %v, want the exit of the focused 8", got)
+	}
+}
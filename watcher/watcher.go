@@ -1,236 +1,717 @@
 package watcher
 
 import (
+	"errors"
 	"log"
-	"path/filepath"
 	"strings"
 	"sync"
-	"syscall"
-	"unsafe"
+	"time"
 
-	"github.com/shirou/gopsutil/v4/process"
-	"golang.org/x/sys/windows"
+	"MSIAfterburnerProfileSwitcher/config"
 )
 
-// WinEvent constants for event-driven watching
-const (
-	eventSystemForeground = 0x0003
-	eventObjectCreate     = 0x8000
-	eventObjectDestroy    = 0x8001
-	wndOutofcontext       = 0x0000
-)
+// Process is a snapshot of a running process.
+// PPID, Exe, Args and CreateTime are empty when the source cannot read them,
+// or leaves them to a ParentSource, ExeSource, CmdlineSource or CreateTimeSource.
+type Process struct {
+	PID        int32
+	PPID       int32
+	Name       string
+	Exe        string
+	Args       []string
+	CreateTime int64 // milliseconds since the epoch
+}
 
-// Lazy-load necessary DLL procedures for performance.
-var (
-	user32                       = windows.NewLazySystemDLL("user32.dll")
-	procGetForegroundWindow      = user32.NewProc("GetForegroundWindow")
-	procGetWindowThreadProcessId = user32.NewProc("GetWindowThreadProcessId")
-	procGetWindowTextW           = user32.NewProc("GetWindowTextW")
-	procGetWindowTextLen         = user32.NewProc("GetWindowTextLengthW")
-	procEnumWindows              = user32.NewProc("EnumWindows")
-	procIsWindowVisible          = user32.NewProc("IsWindowVisible")
-	procSetWinEventHook          = user32.NewProc("SetWinEventHook")
-	procUnhookWinEvent           = user32.NewProc("UnhookWinEvent")
-	procGetMessageW              = user32.NewProc("GetMessageW")
-	procTranslateMessage         = user32.NewProc("TranslateMessage")
-	procDispatchMessageW         = user32.NewProc("DispatchMessageW")
-
-	kernel32        = windows.NewLazySystemDLL("kernel32.dll")
-	procOpenProcess = kernel32.NewProc("OpenProcess")
-	procCloseHandle = kernel32.NewProc("CloseHandle")
-
-	psapi                    = windows.NewLazySystemDLL("psapi.dll")
-	procGetModuleFileNameExW = psapi.NewProc("GetModuleFileNameExW")
-
-	callbackOnce sync.Once
-	callbackPtr  uintptr
-	globalWinEventProc uintptr
-)
+// Window is a snapshot of a visible top-level window.
+type Window struct {
+	PID    int32
+	Title  string
+	Handle uintptr // the HWND on Windows
+}
+
+// Foreground describes the window that currently has the focus.
+type Foreground struct {
+	PID   int32
+	Title string
+	Exe   string
+}
+
+// ProcessSource lists the running processes.
+type ProcessSource interface {
+	Processes() ([]Process, error)
+}
+
+// WindowSource lists the visible top-level windows that have a title.
+type WindowSource interface {
+	Windows() ([]Window, error)
+}
+
+// CmdlineSource reads the command line of a process, for sources that do not fill Process.Args.
+type CmdlineSource interface {
+	Cmdline(pid int32) ([]string, error)
+}
+
+// ParentSource reads the parent pid of a process, for sources that do not fill Process.PPID.
+type ParentSource interface {
+	Parent(pid int32) (int32, error)
+}
+
+// ExeSource reads the executable path of a process, for sources that do not fill Process.Exe.
+type ExeSource interface {
+	Exe(pid int32) (string, error)
+}
+
+// CreateTimeSource reads when a process started, for sources that do not fill Process.CreateTime.
+type CreateTimeSource interface {
+	CreateTime(pid int32) (int64, error)
+}
+
+// EnvironSource reads the environment of a process as "KEY=value" entries.
+type EnvironSource interface {
+	Environ(pid int32) ([]string, error)
+}
+
+// ModuleSource lists the files of the libraries loaded into a process.
+type ModuleSource interface {
+	Modules(pid int32) ([]string, error)
+}
+
+// Usage is the resource usage of a process.
+type Usage struct {
+	CPUTime time.Duration // user and system CPU time since the process started
+	RSS     uint64        // resident memory in bytes
+}
+
+// UsageSource reads the resource usage of a process. It must not block, the Detector
+// computes the CPU percent from the CPU time of consecutive scans.
+type UsageSource interface {
+	Usage(pid int32) (Usage, error)
+}
+
+// ForegroundSource reports the window that currently has the focus.
+type ForegroundSource interface {
+	Foreground() (Foreground, bool)
+}
+
+// Detector looks for targets in the processes and windows reported by its sources.
+// A nil source is skipped, so a Detector without a desktop only checks processes.
+type Detector struct {
+	Processes   ProcessSource
+	Windows     WindowSource
+	Foreground  ForegroundSource
+	Cmdlines    CmdlineSource
+	Parents     ParentSource
+	Exes        ExeSource
+	CreateTimes CreateTimeSource
+	Environs    EnvironSource
+	Modules     ModuleSource
+	Usages      UsageSource
+	// Now returns the current time for runtime conditions, time.Now if nil.
+	Now func() time.Time
 
-type enumContext struct {
-	keywords []string
-	found    string
+	mutex sync.Mutex
+	// lastFocused is the rule that last matched in the foreground and the process it matched, for sticky rules.
+	lastFocused Match
+	// graphics caches the module check of auto-detection per pid.
+	graphics map[int32]graphicsEntry
+	// appIDs caches the Steam AppIDs from the environment per pid.
+	appIDs map[int32]appIDEntry
+	// cpu holds the CPU samples per pid and sampling window, for the CPU percent of usage conditions.
+	cpu map[usageKey]cpuSample
+	// recheck is how long after the last detection a pending condition becomes due, 0 if none.
+	recheck time.Duration
 }
 
-// StartEventWatcher sets up Windows event hooks to listen for system events.
-func StartEventWatcher(handler func()) {
-	go func() {
-		winEventProc := syscall.NewCallback(func(hWinEventHook syscall.Handle, event uint32, hwnd syscall.Handle, idObject int32, idChild int32, idEventThread uint32, dwmsEventTime uint32) uintptr {
-			handler()
-			return 0
-		})
+// NewDetector returns a Detector backed by the native sources of the current platform.
+func NewDetector() *Detector {
+	return newNativeDetector()
+}
+
+var defaultDetector = NewDetector()
+
+// FirstActiveTarget runs Detector.FirstActiveTarget on the native sources.
+func FirstActiveTarget(cfg *config.Config) (string, bool) {
+	return defaultDetector.FirstActiveTarget(cfg)
+}
+
+// ActiveTargets runs Detector.ActiveTargets on the native sources.
+func ActiveTargets(cfg *config.Config) []Match {
+	return defaultDetector.ActiveTargets(cfg)
+}
 
-		hookForeground, _, err := procSetWinEventHook.Call(uintptr(eventSystemForeground), uintptr(eventSystemForeground), 0, winEventProc, 0, 0, uintptr(wndOutofcontext))
-		if hookForeground == 0 {
-			log.Fatalf("Fatal: Could not set foreground event hook: %v", err)
+// TransparentForeground runs Detector.TransparentForeground on the native sources.
+func TransparentForeground(cfg *config.Config) bool {
+	return defaultDetector.TransparentForeground(cfg)
+}
+
+// TransparentForeground reports whether the foreground app is in cfg.Transparent.
+func (d *Detector) TransparentForeground(cfg *config.Config) bool {
+	if d.Foreground == nil {
+		return false
+	}
+	fg, ok := d.Foreground.Foreground()
+	if !ok {
+		return false
+	}
+	return cfg.Transparent.MatchesTitle(fg.Title) || (fg.Exe != "" && cfg.Transparent.MatchesProcess(windowsBase(fg.Exe)))
+}
+
+// Match is a target found by the Detector.
+type Match struct {
+	Key        string // key of the matched rule
+	Foreground bool   // the target has the focus
+	PID        int32  // 0 if unknown
+	CreateTime int64  // start of the process in milliseconds since the epoch, 0 if unknown
+}
+
+// scan holds what one detection has read from the sources,
+// so every checker sees the same process list.
+type scan struct {
+	detector      *Detector
+	cfg           *config.Config
+	rules         []config.Rule // rules of the background checkers
+	processes     []Process
+	processErr    error
+	processesRead bool
+	byPID         map[int32]Process
+	cmdlines      map[int32]string
+	parents       map[int32]int32
+	exes          map[int32]string
+	createTimes   map[int32]int64
+	foregroundPID int32
+	usages        map[usageKey]measurement
+	now           time.Time
+	due           time.Time // the earliest time a condition that did not hold may hold, zero if none
+}
+
+// FirstActiveTarget checks for a target matching one of cfg.Rules, prioritizing the foreground application.
+// Within each checker the rules are tried in the order of cfg.Rules, so when several targets
+// are running the same one wins every time. Processes and windows matched by cfg.Exclude are skipped.
+// The background checkers only try rules whose policy allows a target without focus.
+// It returns the key of the rule that was matched, and a boolean indicating if a match was found.
+func (d *Detector) FirstActiveTarget(cfg *config.Config) (string, bool) {
+	matches := d.detect(cfg, false)
+	if len(matches) == 0 {
+		return "", false
+	}
+	return matches[0].Key, true
+}
+
+// ActiveTargets returns every rule that matches a target, each rule once.
+// The matches are in the order FirstActiveTarget tries them, so the first one is its result.
+func (d *Detector) ActiveTargets(cfg *config.Config) []Match {
+	return d.detect(cfg, true)
+}
+
+// detect runs the checkers in order. Unless all is set it stops at the first checker that finds a target.
+func (d *Detector) detect(cfg *config.Config, all bool) []Match {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s := &scan{detector: d, cfg: cfg, now: time.Now()}
+	if d.Now != nil {
+		s.now = d.Now()
+	}
+	if d.lastFocused.Key != "" && !s.running(d.lastFocused) {
+		d.lastFocused = Match{}
+	}
+	s.rules = backgroundRules(cfg.Rules, d.lastFocused.Key)
+	checkers := []func() []Match{s.getForegroundTarget, s.isProcessActive, s.isGraphicsActive, s.isWindowActive}
+	var matches []Match
+	seen := make(map[string]bool)
+	for _, checker := range checkers {
+		for _, m := range checker() {
+			if !seen[m.Key] {
+				seen[m.Key] = true
+				matches = append(matches, m)
+			}
 		}
+		if len(matches) > 0 && !all {
+			break
+		}
+	}
+	d.recheck = 0
+	if !s.due.IsZero() {
+		d.recheck = s.due.Sub(s.now)
+	}
+	return matches
+}
+
+// RecheckAfter returns how long after the last detection a condition that did not hold yet may hold,
+// like a 'min_runtime' that runs out or the next CPU sample of 'min_cpu'. It returns 0 if no
+// condition is pending. Nothing else changes when these conditions become true, so a caller that
+// does not poll should detect again then.
+func (d *Detector) RecheckAfter() time.Duration {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.recheck
+}
+
+// wake records that a condition of the scan may hold at t.
+func (s *scan) wake(t time.Time) {
+	if t.After(s.now) && (s.due.IsZero() || t.Before(s.due)) {
+		s.due = t
+	}
+}
 
-		hookCreate, _, err := procSetWinEventHook.Call(uintptr(eventObjectCreate), uintptr(eventObjectDestroy), 0, winEventProc, 0, 0, uintptr(wndOutofcontext))
-		if hookCreate == 0 {
-			log.Fatalf("Fatal: Could not set create/destroy event hook: %v", err)
+// backgroundRules returns the rules that may match a target without focus:
+// any-running rules, and a sticky rule if it was the last one to match in the foreground.
+func backgroundRules(rules []config.Rule, lastFocused string) []config.Rule {
+	result := make([]config.Rule, 0, len(rules))
+	for _, rule := range rules {
+		switch rule.Policy {
+		case config.PolicyAnyRunning:
+			result = append(result, rule)
+		case config.PolicySticky:
+			if rule.Key == lastFocused {
+				result = append(result, rule)
+			}
 		}
+	}
+	return result
+}
 
-		defer procUnhookWinEvent.Call(hookForeground)
-		defer procUnhookWinEvent.Call(hookCreate)
+// running reports whether the process of a match is still in the process list. A new process that
+// reused the pid is a different one, so a restarted sticky target needs the focus again.
+// Without a pid or a process list it cannot tell and assumes the process still runs.
+func (s *scan) running(m Match) bool {
+	processes, err := s.processList()
+	if m.PID == 0 || err != nil || processes == nil {
+		return true
+	}
+	if _, ok := s.process(m.PID); !ok {
+		return false
+	}
+	createTime := s.createTime(m.PID)
+	return m.CreateTime == 0 || createTime == 0 || createTime == m.CreateTime
+}
+
+// processList reads the processes once per scan.
+func (s *scan) processList() ([]Process, error) {
+	if !s.processesRead && s.detector.Processes != nil {
+		s.processes, s.processErr = s.detector.Processes.Processes()
+		s.processesRead = true
+	}
+	return s.processes, s.processErr
+}
 
-		var msg struct{ Hwnd, Message, WParam, LParam, Time, Pt uintptr }
-		for {
-			ret, _, _ := procGetMessageW.Call(uintptr(unsafe.Pointer(&msg)), 0, 0, 0)
-			if int32(ret) == -1 {
+// process returns the process with the given pid from the process list.
+func (s *scan) process(pid int32) (Process, bool) {
+	if s.byPID == nil {
+		processes, _ := s.processList()
+		s.byPID = make(map[int32]Process, len(processes))
+		for _, p := range processes {
+			s.byPID[p.PID] = p
+		}
+	}
+	p, ok := s.byPID[pid]
+	return p, ok
+}
+
+// candidate is a text a rule can match, together with the scope it belongs to
+// and the process it was read from.
+type candidate struct {
+	scope string
+	text  string
+	pid   int32
+}
+
+// matchAll returns a Match for every rule that matches any of the candidates, in the order of rules.
+func (s *scan) matchAll(rules []config.Rule, candidates []candidate, foreground bool) []Match {
+	var matches []Match
+	for _, rule := range rules {
+		for _, c := range candidates {
+			if c.text != "" && rule.Covers(c.scope) && rule.Match(c.text) && s.meetsConditions(rule, c.pid) {
+				matches = append(matches, Match{Key: rule.Key, Foreground: foreground, PID: c.pid, CreateTime: s.createTime(c.pid)})
 				break
 			}
-			procTranslateMessage.Call(uintptr(unsafe.Pointer(&msg)))
-			procDispatchMessageW.Call(uintptr(unsafe.Pointer(&msg)))
 		}
-	}()
+	}
+	return matches
 }
 
-// FirstActiveTarget checks for a target using partial matching, prioritizing the foreground application.
-// It returns the *keyword* that was matched, and a boolean indicating if a match was found.
-func FirstActiveTarget(targets map[string]string) (string, bool) {
-	keywords := make([]string, 0, len(targets))
-	for k := range targets {
-		keywords = append(keywords, k)
+// meetsConditions checks the conditions of a rule on the process a candidate was read from.
+func (s *scan) meetsConditions(rule config.Rule, pid int32) bool {
+	if rule.HasArgs() && !rule.MatchArgs(s.cmdline(pid)) {
+		return false
 	}
-	checkers := []func([]string) (string, bool){getForegroundTarget, isProcessActive, isWindowActive}
-	for _, checker := range checkers {
-		if name, ok := checker(keywords); ok {
-			return name, true
+	if !rule.HasParent() && !rule.HasAncestor() && rule.MinRuntimeDuration() == 0 && !rule.HasUsage() {
+		return true
+	}
+	p, ok := s.process(pid)
+	if !ok {
+		return false
+	}
+	if min := rule.MinRuntimeDuration(); min > 0 {
+		if !s.ranFor(p.PID, min) {
+			return false
 		}
 	}
-	return "", false
+	if rule.HasUsage() {
+		m := s.usage(pid, rule.SampleWindow())
+		if m.err != nil || !rule.MatchUsage(m.cpu, m.rss) {
+			return false
+		}
+	}
+	if rule.HasParent() {
+		parent, ok := s.parent(p)
+		if !ok || !rule.MatchParent(parent.Name) {
+			return false
+		}
+	}
+	if rule.HasAncestor() && !s.hasAncestor(p, rule) {
+		return false
+	}
+	return true
 }
 
-// getForegroundTarget checks if the foreground app's process or title contains a keyword.
-func getForegroundTarget(keywords []string) (string, bool) {
-	lowerKeywords := make([]string, len(keywords))
-	for i, kw := range keywords {
-		lowerKeywords[i] = strings.ToLower(kw)
-	}
-	hwnd, _, _ := procGetForegroundWindow.Call()
-	if hwnd == 0 {
-		return "", false
+// steamAppIDVars are the variables Steam sets in the environment of every game it launches.
+var steamAppIDVars = []string{"SteamAppId=", "SteamGameId="}
+
+// appIDEntry caches the Steam AppIDs of a process. The environment a process started with does not
+// change, so it is read once for the lifetime of the process.
+type appIDEntry struct {
+	createTime int64 // tells a new process with a reused pid apart
+	ids        []string
+}
+
+// appIDs returns the Steam AppIDs from the environment of a process, using the cache of the Detector.
+func (s *scan) appIDs(pid int32) []string {
+	createTime := s.createTime(pid)
+	if entry, ok := s.detector.appIDs[pid]; ok && entry.createTime == createTime {
+		return entry.ids
 	}
-	title := getWindowText(windows.HWND(hwnd))
-	if title != "" {
-		if found, ok := containsKeyword(title, lowerKeywords); ok {
-			return found, true
+	var ids []string
+	if s.detector.Environs != nil {
+		env, _ := s.detector.Environs.Environ(pid)
+		for _, entry := range env {
+			for _, prefix := range steamAppIDVars {
+				if id, ok := strings.CutPrefix(entry, prefix); ok && id != "" && id != "0" {
+					ids = append(ids, id)
+				}
+			}
 		}
 	}
-	var pid uint32
-	procGetWindowThreadProcessId.Call(hwnd, uintptr(unsafe.Pointer(&pid)))
-	if pid == 0 {
-		return "", false
+	if s.detector.appIDs == nil {
+		s.detector.appIDs = make(map[int32]appIDEntry)
 	}
-	handle, _, _ := procOpenProcess.Call(windows.PROCESS_QUERY_INFORMATION|windows.PROCESS_VM_READ, 0, uintptr(pid))
-	if handle == 0 {
-		return "", false
+	s.detector.appIDs[pid] = appIDEntry{createTime: createTime, ids: ids}
+	return ids
+}
+
+// prune drops the cached AppIDs and CPU samples of processes that are no longer running.
+func (s *scan) prune(processes []Process) {
+	if len(s.detector.appIDs) == 0 && len(s.detector.cpu) == 0 {
+		return
+	}
+	running := make(map[int32]bool, len(processes))
+	for _, p := range processes {
+		running[p.PID] = true
+	}
+	for pid := range s.detector.appIDs {
+		if !running[pid] {
+			delete(s.detector.appIDs, pid)
+		}
 	}
-	defer procCloseHandle.Call(handle)
-	buf := make([]uint16, windows.MAX_PATH)
-	n, _, _ := procGetModuleFileNameExW.Call(handle, 0, uintptr(unsafe.Pointer(&buf[0])), windows.MAX_PATH)
-	if n > 0 {
-		exePath := windows.UTF16ToString(buf[:n])
-		lowerExeName := strings.ToLower(filepath.Base(exePath))
-		if found, ok := containsKeyword(lowerExeName, lowerKeywords); ok {
-			return found, true
+	for key := range s.detector.cpu {
+		if !running[key.pid] {
+			delete(s.detector.cpu, key)
 		}
 	}
-	return "", false
 }
 
-func containsKeyword(text string, lowerKeywords []string) (string, bool) {
-	lowerText := strings.ToLower(text)
-	for _, kw := range lowerKeywords {
-		if strings.Contains(lowerText, kw) {
-			return kw, true
+// coversScope reports whether any of the rules is matched against the given scope.
+func coversScope(rules []config.Rule, scope string) bool {
+	for _, rule := range rules {
+		if rule.Covers(scope) {
+			return true
 		}
 	}
-	return "", false
+	return false
 }
 
-// isProcessActive checks if any running process name contains a keyword.
-func isProcessActive(keywords []string) (string, bool) {
-	lowerKeywords := make([]string, len(keywords))
-	for i, k := range keywords {
-		lowerKeywords[i] = strings.ToLower(k)
+// usageKey identifies a measurement of a process over a sampling window.
+type usageKey struct {
+	pid    int32
+	window time.Duration
+}
+
+// cpuSample is the start of the sampling window of a process and the CPU percent of the last full window.
+type cpuSample struct {
+	createTime int64 // tells a new process with a reused pid apart
+	at         time.Time
+	cpuTime    time.Duration
+	percent    float64
+	measured   bool // percent is set, the first window has passed
+}
+
+// measurement is the usage of a process as the usage conditions see it.
+type measurement struct {
+	cpu float64 // percent, 100 is one full core
+	rss uint64
+	err error
+}
+
+// errNotMeasured means the first sampling window of a process has not passed yet.
+var errNotMeasured = errors.New("cpu usage not measured yet")
+
+// usage measures a process once per scan and window without waiting. The CPU percent is the average
+// over the last sampling window that has passed, so a process is first measured one window after
+// the scan that first saw it. A window of 0 skips the CPU measurement.
+func (s *scan) usage(pid int32, window time.Duration) measurement {
+	key := usageKey{pid, window}
+	if m, ok := s.usages[key]; ok {
+		return m
 	}
-	processes, err := process.Processes()
-	if err != nil {
-		return "", false
+	if s.usages == nil {
+		s.usages = make(map[usageKey]measurement)
 	}
-	for _, p := range processes {
-		name, err := p.Name()
-		if err != nil {
-			continue
+	var m measurement
+	if s.detector.Usages == nil {
+		m.err = errors.New("no usage source")
+	} else if u, err := s.detector.Usages.Usage(pid); err != nil {
+		m.err = err
+	} else {
+		m.rss = u.RSS
+		if window > 0 {
+			m.cpu, m.err = s.cpuPercent(key, u.CPUTime)
 		}
-		lowerName := strings.ToLower(name)
-		for _, kw := range lowerKeywords {
-			if strings.Contains(lowerName, kw) {
-				return kw, true
-			}
+	}
+	s.usages[key] = m
+	return m
+}
+
+// cpuPercent updates the CPU sample of a process and returns the percent of the last full window.
+// The usage may change with every window, so the scan wakes when the current one is over.
+func (s *scan) cpuPercent(key usageKey, cpuTime time.Duration) (float64, error) {
+	createTime := s.createTime(key.pid)
+	if s.detector.cpu == nil {
+		s.detector.cpu = make(map[usageKey]cpuSample)
+	}
+	sample, ok := s.detector.cpu[key]
+	if !ok || sample.createTime != createTime || cpuTime < sample.cpuTime {
+		s.detector.cpu[key] = cpuSample{createTime: createTime, at: s.now, cpuTime: cpuTime}
+		s.wake(s.now.Add(key.window))
+		return 0, errNotMeasured
+	}
+	if elapsed := s.now.Sub(sample.at); elapsed >= key.window {
+		sample.percent = 100 * float64(cpuTime-sample.cpuTime) / float64(elapsed)
+		sample.measured = true
+		sample.at, sample.cpuTime = s.now, cpuTime
+		s.detector.cpu[key] = sample
+	}
+	s.wake(sample.at.Add(key.window))
+	if !sample.measured {
+		return 0, errNotMeasured
+	}
+	return sample.percent, nil
+}
+
+// maxAncestors bounds the walk up the process tree.
+const maxAncestors = 32
+
+// hasAncestor reports whether any ancestor of p meets the ancestor condition of the rule.
+func (s *scan) hasAncestor(p Process, rule config.Rule) bool {
+	for i := 0; i < maxAncestors; i++ {
+		parent, ok := s.parent(p)
+		if !ok {
+			return false
 		}
+		if rule.MatchAncestor(parent.Name) {
+			return true
+		}
+		p = parent
 	}
-	return "", false
+	return false
 }
 
-// isWindowActive checks if any visible window title contains a keyword.
-func isWindowActive(keywords []string) (string, bool) {
-	ctx := enumContext{
-		keywords: keywords,
-		found:    "",
+// parent returns the parent of p from the process list.
+// A parent that started after p is a new process that reused the pid of the real parent, it is not returned.
+func (s *scan) parent(p Process) (Process, bool) {
+	ppid := p.PPID
+	if ppid == 0 {
+		ppid = s.parentPID(p.PID)
 	}
-	cb := getEnumWindowsCallback()
-	ret, _, err := procEnumWindows.Call(
-		cb,
-		uintptr(unsafe.Pointer(&ctx)),
-	)
-	if ret == 0 && ctx.found == "" && err != nil {
-		log.Printf("EnumWindows failed: %v", err)
+	if ppid == 0 || ppid == p.PID {
+		return Process{}, false
+	}
+	parent, ok := s.process(ppid)
+	if !ok {
+		return Process{}, false
 	}
-	if ctx.found != "" {
-		return ctx.found, true
+	if started, childStarted := s.createTime(parent.PID), s.createTime(p.PID); started != 0 && childStarted != 0 && started > childStarted {
+		return Process{}, false
 	}
-	return "", false
+	return parent, true
 }
 
-func getEnumWindowsCallback() uintptr {
-	callbackOnce.Do(func() {
-		callbackPtr = windows.NewCallback(func(hwnd windows.HWND, lParam uintptr) uintptr {
-			ctx := (*enumContext)(unsafe.Pointer(lParam))
-			visible, _, _ := procIsWindowVisible.Call(uintptr(hwnd))
-			if visible == 0 {
-				return 1
-			}
-			title := getWindowText(hwnd)
-			if title == "" {
-				return 1
-			}
-			for _, keyword := range ctx.keywords {
-				if containsFold(title, keyword) {
-					ctx.found = keyword
-					return 0
-				}
-			}
-			return 1
-		})
-	})
-	return callbackPtr
+// parentPID looks up the parent pid through the ParentSource, once per scan.
+func (s *scan) parentPID(pid int32) int32 {
+	if s.detector.Parents == nil {
+		return 0
+	}
+	if ppid, ok := s.parents[pid]; ok {
+		return ppid
+	}
+	if s.parents == nil {
+		s.parents = make(map[int32]int32)
+	}
+	ppid, _ := s.detector.Parents.Parent(pid)
+	s.parents[pid] = ppid
+	return ppid
+}
+
+// exe returns the executable path of p, looked up through the ExeSource once per scan
+// if the process list does not carry it.
+func (s *scan) exe(p Process) string {
+	if p.Exe != "" || s.detector.Exes == nil || p.PID == 0 {
+		return p.Exe
+	}
+	if exe, ok := s.exes[p.PID]; ok {
+		return exe
+	}
+	if s.exes == nil {
+		s.exes = make(map[int32]string)
+	}
+	exe, _ := s.detector.Exes.Exe(p.PID)
+	s.exes[p.PID] = exe
+	return exe
+}
+
+// createTime returns when a process started in milliseconds since the epoch, 0 if unknown.
+// It is looked up through the CreateTimeSource once per scan if the process list does not carry it.
+func (s *scan) createTime(pid int32) int64 {
+	p, ok := s.process(pid)
+	if ok && p.CreateTime != 0 || s.detector.CreateTimes == nil || pid == 0 {
+		return p.CreateTime
+	}
+	if createTime, ok := s.createTimes[pid]; ok {
+		return createTime
+	}
+	if s.createTimes == nil {
+		s.createTimes = make(map[int32]int64)
+	}
+	createTime, _ := s.detector.CreateTimes.CreateTime(pid)
+	s.createTimes[pid] = createTime
+	return createTime
 }
 
-func containsFold(s, substr string) bool {
-	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+// ranFor reports whether a process has been running for at least d. A process whose start is unknown has not.
+// A process that has not run long enough yet wakes the scan when it will have.
+func (s *scan) ranFor(pid int32, d time.Duration) bool {
+	createTime := s.createTime(pid)
+	if createTime == 0 {
+		return false
+	}
+	due := time.UnixMilli(createTime).Add(d)
+	if s.now.Before(due) {
+		s.wake(due)
+		return false
+	}
+	return true
 }
 
-func getWindowText(hwnd windows.HWND) string {
-	length, _, _ := procGetWindowTextLen.Call(uintptr(hwnd))
-	if length == 0 {
-		return ""
+// cmdline returns the command line of a process with the arguments joined by spaces.
+// It is looked up once per scan, however many rules ask for it.
+func (s *scan) cmdline(pid int32) string {
+	if cmdline, ok := s.cmdlines[pid]; ok {
+		return cmdline
+	}
+	if s.cmdlines == nil {
+		s.cmdlines = make(map[int32]string)
+	}
+	args := []string(nil)
+	if p, ok := s.process(pid); ok {
+		args = p.Args
+	}
+	if args == nil && s.detector.Cmdlines != nil && pid != 0 {
+		args, _ = s.detector.Cmdlines.Cmdline(pid)
+	}
+	s.cmdlines[pid] = strings.Join(args, " ")
+	return s.cmdlines[pid]
+}
+
+// getForegroundTarget checks if the foreground app's title, exe name, exe path or Steam AppID matches a rule.
+// All rules are tried regardless of their policy, and the best match is remembered for sticky rules.
+func (s *scan) getForegroundTarget() []Match {
+	if s.detector.Foreground == nil {
+		return nil
+	}
+	fg, ok := s.detector.Foreground.Foreground()
+	if !ok {
+		return nil
+	}
+	s.foregroundPID = fg.PID
+	var candidates []candidate
+	if !s.cfg.Exclude.MatchesTitle(fg.Title) {
+		candidates = append(candidates, candidate{config.ScopeTitle, fg.Title, fg.PID})
+	}
+	if fg.Exe != "" {
+		name := windowsBase(fg.Exe)
+		if s.cfg.Exclude.MatchesProcess(name) {
+			return nil
+		}
+		candidates = append(candidates, candidate{config.ScopeExe, name, fg.PID}, candidate{config.ScopePath, fg.Exe, fg.PID})
+	}
+	if fg.PID != 0 && coversScope(s.cfg.Rules, config.ScopeAppID) {
+		for _, id := range s.appIDs(fg.PID) {
+			candidates = append(candidates, candidate{config.ScopeAppID, id, fg.PID})
+		}
 	}
-	buf := make([]uint16, length+1)
-	ret, _, _ := procGetWindowTextW.Call(uintptr(hwnd), uintptr(unsafe.Pointer(&buf[0])), length+1)
-	if ret == 0 {
-		return ""
+	matches := s.matchAll(s.cfg.Rules, candidates, true)
+	if len(matches) > 0 {
+		s.detector.lastFocused = matches[0]
+	}
+	return matches
+}
+
+// isProcessActive checks if any running process name, exe path or Steam AppID matches a rule.
+func (s *scan) isProcessActive() []Match {
+	processes, err := s.processList()
+	if err != nil {
+		return nil
+	}
+	s.prune(processes)
+	withAppIDs := coversScope(s.rules, config.ScopeAppID)
+	withPaths := coversScope(s.rules, config.ScopePath)
+	candidates := make([]candidate, 0, 2*len(processes))
+	for _, p := range processes {
+		if s.cfg.Exclude.MatchesProcess(p.Name) {
+			continue
+		}
+		candidates = append(candidates, candidate{config.ScopeExe, p.Name, p.PID})
+		if withPaths {
+			candidates = append(candidates, candidate{config.ScopePath, s.exe(p), p.PID})
+		}
+		if withAppIDs {
+			for _, id := range s.appIDs(p.PID) {
+				candidates = append(candidates, candidate{config.ScopeAppID, id, p.PID})
+			}
+		}
+	}
+	return s.matchAll(s.rules, candidates, false)
+}
+
+// isWindowActive checks if any visible window title matches a rule.
+func (s *scan) isWindowActive() []Match {
+	if s.detector.Windows == nil {
+		return nil
+	}
+	windows, err := s.detector.Windows.Windows()
+	if err != nil {
+		log.Printf("EnumWindows failed: %v", err)
+		return nil
+	}
+	candidates := make([]candidate, 0, len(windows))
+	for _, w := range windows {
+		if s.cfg.Exclude.MatchesTitle(w.Title) {
+			continue
+		}
+		if len(s.cfg.Exclude.Processes) > 0 {
+			if p, ok := s.process(w.PID); ok && s.cfg.Exclude.MatchesProcess(p.Name) {
+				continue
+			}
+		}
+		candidates = append(candidates, candidate{config.ScopeTitle, w.Title, w.PID})
 	}
-	return windows.UTF16ToString(buf[:ret])
+	return s.matchAll(s.rules, candidates, false)
 }
@@ -0,0 +1,13 @@
+package watcher
+
+// newNativeDetector reads processes from /proc, there is no desktop to query for windows.
+// Command lines and parents come with the process list, usage is measured through gopsutil.
+func newNativeDetector() *Detector {
+	source := procSource{root: "/proc"}
+	return &Detector{
+		Processes: source,
+		Environs:  source,
+		Modules:   source,
+		Usages:    gopsutilSource{},
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows && !linux
+
+package watcher
+
+// newNativeDetector only checks processes, there is no desktop to query for windows.
+func newNativeDetector() *Detector {
+	return &Detector{
+		Processes:   gopsutilSource{},
+		Cmdlines:    gopsutilSource{},
+		Parents:     gopsutilSource{},
+		Exes:        gopsutilSource{},
+		CreateTimes: gopsutilSource{},
+		Environs:    gopsutilSource{},
+		Usages:      gopsutilSource{},
+	}
+}
@@ -0,0 +1,241 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	"MSIAfterburnerProfileSwitcher/config"
+	"MSIAfterburnerProfileSwitcher/internal/configtest"
+)
+
+func TestFakeSourceForegroundWins(t *testing.T) {
+	cfg := configtest.Load(t, `"overrides": {"exact:background.exe": "-Profile3", "exact:focused.exe": "-Profile4"}`)
+	src := NewFakeSource(Snapshot{
+		Processes:  []Process{{PID: 1, Name: "background.exe"}, {PID: 2, Name: "focused.exe"}},
+		Foreground: &Foreground{PID: 2, Exe: `C:\Games\focused.exe`, Title: "Focused"},
+	})
+	key, ok := src.Detector().FirstActiveTarget(&cfg)
+	if !ok || key != "exact:focused.exe" {
+		t.Fatalf("FirstActiveTarget = %q, %v, want the foreground target", key, ok)
+	}
+}
+
+func TestFakeSourceScript(t *testing.T) {
+	cfg := configtest.Load(t, `"overrides": {"exact:game.exe": "-Profile3", "Benchmark Window": "-Profile4"},
+		"exclude": {"processes": ["exact:chrome.exe"]}`)
+	src := NewFakeSource(
+		Snapshot{},
+		Snapshot{Processes: []Process{{PID: 1, Name: "game.exe"}}},
+		Snapshot{
+			Processes: []Process{{PID: 2, Name: "chrome.exe"}, {PID: 3, Name: "bench.exe"}},
+			Windows:   []Window{{PID: 2, Title: "Benchmark Window - Chrome"}, {PID: 3, Title: "Benchmark Window"}},
+		},
+		Snapshot{
+			Processes: []Process{{PID: 2, Name: "chrome.exe"}},
+			Windows:   []Window{{PID: 2, Title: "Benchmark Window"}},
+		},
+	)
+	d := src.Detector()
+	want := []string{"", "exact:game.exe", "benchmark window", ""}
+	for i, w := range want {
+		if i > 0 && !src.Advance() {
+			t.Fatalf("script ended at snapshot %d", i)
+		}
+		key, ok := d.FirstActiveTarget(&cfg)
+		if key != w || ok != (w != "") {
+			t.Errorf("snapshot %d: FirstActiveTarget = %q, %v, want %q", i, key, ok, w)
+		}
+	}
+	if src.Advance() {
+		t.Error("Advance went past the end of the script")
+	}
+}
+
+// stableConfig has several rules that all match the running processes.
+const stableConfig = `"overrides": {
+	"game": "-Profile3",
+	"tool": "-Profile4",
+	"glob:*.exe": "-Profile5",
+	"exact:tool.exe": "-Profile4"
+}`
+
+func TestFirstActiveTargetIsStable(t *testing.T) {
+	src := NewFakeSource(Snapshot{Processes: []Process{{PID: 1, Name: "game.exe"}, {PID: 2, Name: "tool.exe"}}})
+	d := src.Detector()
+	const want = "exact:tool.exe" // the most specific key, as all rules have the same priority
+	var cfg config.Config
+	for i := 0; i < 1000; i++ {
+		// Load the config again every few rounds, so the map order of 'overrides' changes too.
+		if i%100 == 0 {
+			cfg = configtest.Load(t, stableConfig)
+		}
+		if key, ok := d.FirstActiveTarget(&cfg); !ok || key != want {
+			t.Fatalf("iteration %d: FirstActiveTarget = %q, %v, want %q", i, key, ok, want)
+		}
+	}
+}
+
+func TestFirstActiveTargetPriorityThenOrder(t *testing.T) {
+	cfg := configtest.Load(t, `"overrides": {
+		"exact:alpha.exe": "-Profile3",
+		"exact:bravo.exe": "-Profile4",
+		"exact:urgent.exe": {"profile": "-Profile5", "priority": 10}
+	}`)
+	src := NewFakeSource(
+		Snapshot{Processes: []Process{{PID: 2, Name: "bravo.exe"}, {PID: 1, Name: "alpha.exe"}}},
+		Snapshot{Processes: []Process{{PID: 2, Name: "bravo.exe"}, {PID: 1, Name: "alpha.exe"}, {PID: 3, Name: "urgent.exe"}}},
+	)
+	d := src.Detector()
+	// Equally specific keys go by their order in the file, a higher priority beats both.
+	for _, want := range []string{"exact:alpha.exe", "exact:urgent.exe"} {
+		for i := 0; i < 500; i++ {
+			if key, ok := d.FirstActiveTarget(&cfg); !ok || key != want {
+				t.Fatalf("iteration %d: FirstActiveTarget = %q, %v, want %q", i, key, ok, want)
+			}
+		}
+		src.Advance()
+	}
+}
+
+func TestStickyTargetNeedsFocusAfterRestart(t *testing.T) {
+	cfg := configtest.Load(t, `"foreground_policy": "sticky",
+		"overrides": {"exact:game.exe": "-Profile3"}`)
+	game := Process{PID: 1, Name: "game.exe", CreateTime: 1000}
+	other := Process{PID: 9, Name: "explorer.exe"}
+	src := NewFakeSource(
+		Snapshot{Processes: []Process{game, other}, Foreground: &Foreground{PID: 1, Exe: `C:\Games\game.exe`}},
+		Snapshot{Processes: []Process{game, other}, Foreground: &Foreground{PID: 9, Exe: `C:\Windows\explorer.exe`}},
+		Snapshot{Processes: []Process{other}},
+		Snapshot{Processes: []Process{{PID: 2, Name: "game.exe", CreateTime: 5000}, other}},
+		Snapshot{Processes: []Process{game, other}, Foreground: &Foreground{PID: 1, Exe: `C:\Games\game.exe`}},
+		// The pid of the game is reused by a new game.exe that never had the focus.
+		Snapshot{Processes: []Process{{PID: 1, Name: "game.exe", CreateTime: 9000}, other}},
+	)
+	d := src.Detector()
+	want := []string{"exact:game.exe", "exact:game.exe", "", "", "exact:game.exe", ""}
+	for i, w := range want {
+		if i > 0 {
+			src.Advance()
+		}
+		key, ok := d.FirstActiveTarget(&cfg)
+		if key != w || ok != (w != "") {
+			t.Errorf("snapshot %d: FirstActiveTarget = %q, %v, want %q", i, key, ok, w)
+		}
+	}
+}
+
+func TestUsageFromConsecutiveScans(t *testing.T) {
+	cfg := configtest.Load(t, `"overrides": {
+		"exact:bench.exe": {"profile": "-Profile5", "min_cpu": 50, "sample": "1s"},
+		"exact:big.exe": {"profile": "-Profile4", "min_memory_mb": 100}
+	}`)
+	processes := []Process{{PID: 1, Name: "bench.exe", CreateTime: 1}, {PID: 2, Name: "big.exe", CreateTime: 1}}
+	at := func(cpu time.Duration) Snapshot {
+		return Snapshot{Processes: processes, Usages: map[int32]Usage{1: {CPUTime: cpu}, 2: {RSS: 200 << 20}}}
+	}
+	src := NewFakeSource(at(0), at(400*time.Millisecond), at(800*time.Millisecond), at(810*time.Millisecond), at(820*time.Millisecond))
+	d := src.Detector()
+	start := time.Unix(1000, 0)
+	now := start
+	d.Now = func() time.Time { return now }
+	// bench.exe uses 80% of a core in its first second, then 2%.
+	steps := []struct {
+		after time.Duration
+		bench bool
+	}{
+		{0, false},                      // the first scan only takes a sample
+		{500 * time.Millisecond, false}, // the window has not passed yet
+		{time.Second, true},             // 800ms of CPU time in one second
+		{1500 * time.Millisecond, true}, // the last full window still counts
+		{2 * time.Second, false},        // 20ms in the second window
+	}
+	for i, step := range steps {
+		if i > 0 {
+			src.Advance()
+		}
+		now = start.Add(step.after)
+		var bench, big bool
+		for _, m := range d.ActiveTargets(&cfg) {
+			bench = bench || m.Key == "exact:bench.exe"
+			big = big || m.Key == "exact:big.exe"
+		}
+		if bench != step.bench || !big {
+			t.Errorf("after %s: bench.exe matched %v, big.exe matched %v, want %v and true", step.after, bench, big, step.bench)
+		}
+	}
+}
+
+// lazySource reports processes by name only and counts the lookups of their exe paths and start times.
+type lazySource struct {
+	processes   []Process
+	exes        map[int32]int
+	createTimes map[int32]int
+}
+
+func (l *lazySource) Processes() ([]Process, error) {
+	return l.processes, nil
+}
+
+func (l *lazySource) Exe(pid int32) (string, error) {
+	l.exes[pid]++
+	return `C:\Games\` + l.processes[pid-1].Name, nil
+}
+
+func (l *lazySource) CreateTime(pid int32) (int64, error) {
+	l.createTimes[pid]++
+	return int64(pid) * 1000, nil
+}
+
+func TestExeAndCreateTimeAreReadLazily(t *testing.T) {
+	src := &lazySource{
+		processes:   []Process{{PID: 1, Name: "game.exe"}, {PID: 2, Name: "tool.exe"}, {PID: 3, Name: "other.exe"}},
+		exes:        make(map[int32]int),
+		createTimes: make(map[int32]int),
+	}
+	d := &Detector{Processes: src, Exes: src, CreateTimes: src}
+	cfg := configtest.Load(t, `"overrides": {"exact:game.exe": "-Profile3"}`)
+	matches := d.ActiveTargets(&cfg)
+	if len(matches) != 1 || matches[0].CreateTime != 1000 {
+		t.Fatalf("ActiveTargets = %+v, want game.exe with its start time", matches)
+	}
+	if len(src.exes) != 0 {
+		t.Errorf("exe paths read %v without a path rule", src.exes)
+	}
+	if len(src.createTimes) != 1 || src.createTimes[1] != 1 {
+		t.Errorf("start times read %v, want only the one of the match", src.createTimes)
+	}
+
+	cfg = configtest.Load(t, `"overrides": {"dir:C:\\Games": "-Profile3"}`)
+	if matches := d.ActiveTargets(&cfg); len(matches) != 1 || matches[0].PID != 1 {
+		t.Fatalf("ActiveTargets = %+v, want the first process below C:\\Games", matches)
+	}
+	if len(src.exes) != 3 {
+		t.Errorf("exe paths read %v, want every process once for a dir rule", src.exes)
+	}
+}
+
+func TestRecheckAfterPendingConditions(t *testing.T) {
+	cfg := configtest.Load(t, `"overrides": {
+		"exact:game.exe": {"profile": "-Profile3", "min_runtime": "30s"},
+		"exact:bench.exe": {"profile": "-Profile4", "min_cpu": 50, "sample": "2s"}
+	}`)
+	now := time.Unix(1000, 0)
+	started := func(ago time.Duration) int64 { return now.Add(-ago).UnixMilli() }
+	src := NewFakeSource(
+		Snapshot{Processes: []Process{{PID: 1, Name: "game.exe", CreateTime: started(10 * time.Second)}}},
+		Snapshot{Processes: []Process{{PID: 1, Name: "game.exe", CreateTime: started(10 * time.Second)}, {PID: 2, Name: "bench.exe", CreateTime: 1}},
+			Usages: map[int32]Usage{2: {}}},
+		Snapshot{Processes: []Process{{PID: 1, Name: "game.exe", CreateTime: started(time.Hour)}}},
+	)
+	d := src.Detector()
+	d.Now = func() time.Time { return now }
+	for i, want := range []time.Duration{20 * time.Second, 2 * time.Second, 0} {
+		if i > 0 {
+			src.Advance()
+		}
+		d.ActiveTargets(&cfg)
+		if got := d.RecheckAfter(); got != want {
+			t.Errorf("snapshot %d: RecheckAfter() = %s, want %s", i, got, want)
+		}
+	}
+}
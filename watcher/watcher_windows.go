@@ -0,0 +1,171 @@
+package watcher
+
+import (
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// WinEvent constants for event-driven watching
+const (
+	eventSystemForeground = 0x0003
+	eventObjectCreate     = 0x8000
+	eventObjectDestroy    = 0x8001
+	wndOutofcontext       = 0x0000
+	wmQuit                = 0x0012
+	pmNoRemove            = 0x0000
+
+	// Object and child ID of an event for the window itself, not a part of it like a caret or scroll bar.
+	objidWindow = 0
+	childidSelf = 0
+)
+
+// Lazy-load necessary DLL procedures for performance.
+var (
+	user32                       = windows.NewLazySystemDLL("user32.dll")
+	procGetForegroundWindow      = user32.NewProc("GetForegroundWindow")
+	procGetWindowThreadProcessId = user32.NewProc("GetWindowThreadProcessId")
+	procGetWindowTextW           = user32.NewProc("GetWindowTextW")
+	procGetWindowTextLen         = user32.NewProc("GetWindowTextLengthW")
+	procEnumWindows              = user32.NewProc("EnumWindows")
+	procIsWindowVisible          = user32.NewProc("IsWindowVisible")
+	procSetWinEventHook          = user32.NewProc("SetWinEventHook")
+	procUnhookWinEvent           = user32.NewProc("UnhookWinEvent")
+	procGetMessageW              = user32.NewProc("GetMessageW")
+	procTranslateMessage         = user32.NewProc("TranslateMessage")
+	procDispatchMessageW         = user32.NewProc("DispatchMessageW")
+	procPostThreadMessageW       = user32.NewProc("PostThreadMessageW")
+	procPeekMessageW             = user32.NewProc("PeekMessageW")
+
+	kernel32        = windows.NewLazySystemDLL("kernel32.dll")
+	procOpenProcess = kernel32.NewProc("OpenProcess")
+	procCloseHandle = kernel32.NewProc("CloseHandle")
+
+	psapi                    = windows.NewLazySystemDLL("psapi.dll")
+	procGetModuleFileNameExW = psapi.NewProc("GetModuleFileNameExW")
+
+	callbackOnce sync.Once
+	callbackPtr  uintptr
+
+	// enumMutex guards enumWindows, which collects the results of the EnumWindows callback.
+	enumMutex   sync.Mutex
+	enumWindows []Window
+)
+
+// newNativeDetector uses gopsutil for processes and user32 for windows.
+func newNativeDetector() *Detector {
+	return &Detector{
+		Processes:   gopsutilSource{},
+		Windows:     win32Source{},
+		Foreground:  win32Source{},
+		Cmdlines:    gopsutilSource{},
+		Parents:     gopsutilSource{},
+		Exes:        gopsutilSource{},
+		CreateTimes: gopsutilSource{},
+		Environs:    gopsutilSource{},
+		Modules:     win32Source{},
+		Usages:      gopsutilSource{},
+	}
+}
+
+// win32Source reads windows and the foreground window through user32, and modules through kernel32.
+type win32Source struct{}
+
+// Foreground returns the title and executable of the foreground window.
+func (win32Source) Foreground() (Foreground, bool) {
+	hwnd, _, _ := procGetForegroundWindow.Call()
+	if hwnd == 0 {
+		return Foreground{}, false
+	}
+	fg := Foreground{Title: getWindowText(windows.HWND(hwnd)), PID: windowPID(hwnd)}
+	if fg.PID == 0 {
+		return fg, true
+	}
+	fg.Exe = getProcessExePath(uint32(fg.PID))
+	return fg, true
+}
+
+// getProcessExePath returns the full executable path of a process, or "" if it cannot be opened.
+func getProcessExePath(pid uint32) string {
+	handle, _, _ := procOpenProcess.Call(windows.PROCESS_QUERY_INFORMATION|windows.PROCESS_VM_READ, 0, uintptr(pid))
+	if handle == 0 {
+		return ""
+	}
+	defer procCloseHandle.Call(handle)
+	buf := make([]uint16, windows.MAX_PATH)
+	n, _, _ := procGetModuleFileNameExW.Call(handle, 0, uintptr(unsafe.Pointer(&buf[0])), windows.MAX_PATH)
+	if n == 0 {
+		return ""
+	}
+	return windows.UTF16ToString(buf[:n])
+}
+
+// Modules lists the DLLs loaded into a process through a toolhelp snapshot.
+func (win32Source) Modules(pid int32) ([]string, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPMODULE|windows.TH32CS_SNAPMODULE32, uint32(pid))
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(snapshot)
+	entry := windows.ModuleEntry32{Size: uint32(windows.SizeofModuleEntry32)}
+	if err := windows.Module32First(snapshot, &entry); err != nil {
+		return nil, err
+	}
+	var modules []string
+	for {
+		modules = append(modules, windows.UTF16ToString(entry.ExePath[:]))
+		if err := windows.Module32Next(snapshot, &entry); err != nil {
+			break
+		}
+	}
+	return modules, nil
+}
+
+// Windows returns all visible top-level windows that have a title.
+func (win32Source) Windows() ([]Window, error) {
+	enumMutex.Lock()
+	defer enumMutex.Unlock()
+	enumWindows = nil
+	cb := getEnumWindowsCallback()
+	ret, _, err := procEnumWindows.Call(cb, 0)
+	if ret == 0 {
+		return nil, err
+	}
+	result := enumWindows
+	enumWindows = nil
+	return result, nil
+}
+
+func getEnumWindowsCallback() uintptr {
+	callbackOnce.Do(func() {
+		callbackPtr = windows.NewCallback(func(hwnd windows.HWND, lParam uintptr) uintptr {
+			visible, _, _ := procIsWindowVisible.Call(uintptr(hwnd))
+			if visible == 0 {
+				return 1
+			}
+			title := getWindowText(hwnd)
+			if title == "" {
+				return 1
+			}
+			var pid uint32
+			procGetWindowThreadProcessId.Call(uintptr(hwnd), uintptr(unsafe.Pointer(&pid)))
+			enumWindows = append(enumWindows, Window{PID: int32(pid), Title: title, Handle: uintptr(hwnd)})
+			return 1
+		})
+	})
+	return callbackPtr
+}
+
+func getWindowText(hwnd windows.HWND) string {
+	length, _, _ := procGetWindowTextLen.Call(uintptr(hwnd))
+	if length == 0 {
+		return ""
+	}
+	buf := make([]uint16, length+1)
+	ret, _, _ := procGetWindowTextW.Call(uintptr(hwnd), uintptr(unsafe.Pointer(&buf[0])), length+1)
+	if ret == 0 {
+		return ""
+	}
+	return windows.UTF16ToString(buf[:ret])
+}